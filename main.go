@@ -2,104 +2,195 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
-	"sync"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"wunderbase/pkg/api"
+	"wunderbase/pkg/config"
 	"wunderbase/pkg/migrate"
 	"wunderbase/pkg/queryengine"
 
-	"github.com/caarlos0/env/v6"
+	"github.com/go-redis/redis/v8"
 )
 
-type config struct {
-	// Data Proxy Wrapper
-	ApiKey            string `env:"API_KEY" envDefault:"SECRET_API_KEY"`
-	Production        bool   `env:"PRODUCTION" envDefault:"false"`
-	EnableSleepMode   bool   `env:"ENABLE_SLEEP_MODE" envDefault:"false"`
-	SleepAfterSeconds int    `env:"SLEEP_AFTER_SECONDS" envDefault:"10"`
-	ListenAddr        string `env:"LISTEN_ADDR" envDefault:"0.0.0.0:4466"`
-	GraphiQLApiURL    string `env:"GRAPHIQL_API_URL" envDefault:"http://localhost:4466"`
-	ReadLimitSeconds  int    `env:"READ_LIMIT_SECONDS" envDefault:"10000"`
-	WriteLimitSeconds int    `env:"WRITE_LIMIT_SECONDS" envDefault:"2000"`
-	HealthEndpoint    string `env:"HEALTH_ENDPOINT" envDefault:"/health"`
-
-	// Prisma
-	PrismaVersion string `env:"PRISMA_VERSION" envDefault:"4bc8b6e1b66cb932731fb1bdbbc550d1e010de81"` // 4.4.0-29 @ https://github.com/prisma/engines-wrapper/blob/main/packages/engines-version/package.json
-
-	// Prisma Migration Engine - Schema
-	PrismaSchemaFilePath  string `env:"PRISMA_SCHEMA_FILE" envDefault:"./schema.prisma"`
-	EnableMigration       bool   `env:"ENABLE_MIGRATION" envDefault:"false"`
-	MigrationLockFilePath string `env:"MIGRATION_LOCK_FILE" envDefault:"migration.lock"`
-	MigrationEnginePath   string `env:"MIGRATION_ENGINE_PATH" envDefault:"./migration-engine"`
-
-	// I think that we should discard `EnablePlayground`, when we add `Production` flag.
-	// EnablePlayground      bool   `env:"ENABLE_PLAYGROUND" envDefault:"true"`
-
-	// Prisma Query Engine - Instance
-	QueryEnginePath     string `env:"QUERY_ENGINE_PATH" envDefault:"./query-engine"`
-	QueryEnginePort     string `env:"QUERY_ENGINE_PORT" envDefault:"4467"`
-	QueryEngineHostBind string `env:"QUERY_ENGINE_HOST_BIND" envDefault:"127.0.0.1"`
-	QueryEngineLog      bool   `env:"QUERY_ENGINE_LOG" envDefault:"false"`
-	EnableRawQueries    bool   `env:"QUERY_ENGINE_RAW_QUERIES" envDefault:"true"`
-	// Prisma Query Engine - Trace && Metrics
-	EnableMetrics         bool `env:"ENABLE_METRICS" envDefault:"true"`
-	EnableOpenTelemetry   bool `env:"ENABLE_OPEN_TELEMETRY" envDefault:"false"`
-	OpenTelemetryEndpoint string `env:"OPEN_TELEMETRY_ENDPOINT" envDefault:""`
-	EnableTelemetryInResponse bool `env:"ENABLE_TELEMETRY_IN_RESPONSE" envDefault:"false"`
-
-	// Redis Config
-	RedisRestAPIEnable bool   `env:"REDIS_REST_API_ENABLE" envDefault:"false"`
-	RedisAddress       string `env:"REDIS_ADDRESS" envDefault:"localhost:6379"`
-	RedisPassword      string `env:"REDIS_PASSWORD" envDefault:""`
-	RedisDB            int    `env:"REDIS_DB" envDefault:"0"`
-}
-
 func main() {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	wg := &sync.WaitGroup{}
-	wg.Add(2)
-	config := &config{}
-	if err := env.Parse(config); err != nil {
-		log.Fatalln("parse env", err)
-	}
-	api.AdditionalConfig.ApiKey = config.ApiKey
-	api.AdditionalConfig.EnableRawQueries = config.EnableRawQueries
-	api.AdditionalConfig.EnableQueryEngineLog = config.QueryEngineLog
-	api.AdditionalConfig.EnableMetrics = config.EnableMetrics
-	api.AdditionalConfig.QueryEngineHostBind = config.QueryEngineHostBind
-	api.AdditionalConfig.EnableTelemetryInResponse = config.EnableTelemetryInResponse
-	api.AdditionalConfig.OpenTelemetryEndpoint = config.OpenTelemetryEndpoint
-	api.AdditionalConfig.EnableOpenTelemetry = config.EnableOpenTelemetry
-	api.RedisConfig.RedisEnable = config.RedisRestAPIEnable
-	api.RedisConfig.RedisAddress = config.RedisAddress
-	api.RedisConfig.RedisPassword = config.RedisPassword
-	api.RedisConfig.RedisDB = config.RedisDB
-	schema, err := ioutil.ReadFile(config.PrismaSchemaFilePath)
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML config file, environment variables override its values")
+	flag.Parse()
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		log.Fatalln("load config", err)
+	}
+	validationErr := cfg.Validate()
+	// `config print` dumps the effective config with secrets redacted
+	if flag.Arg(0) == "config" && flag.Arg(1) == "print" {
+		err = cfg.Print(os.Stdout)
+		if err != nil {
+			log.Fatalln("print config", err)
+		}
+		if validationErr != nil {
+			fmt.Fprintln(os.Stderr, validationErr)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if validationErr != nil {
+		log.Fatalln(validationErr)
+	}
+	migrationOptions := migrate.Options{
+		MigrationEnginePath: cfg.MigrationEnginePath,
+		LockFilePath:        cfg.MigrationLockFilePath,
+		SchemaPath:          cfg.PrismaSchemaFilePath,
+		EngineVersion:       cfg.PrismaVersion,
+		AllowDataLoss:       cfg.MigrationAllowDataLoss,
+		MigrationsDir:       cfg.MigrationsDir,
+		Timeout:             time.Duration(cfg.MigrationTimeoutSeconds) * time.Second,
+	}
+
+	// ctx is cancelled by SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	_, err = os.Stat(cfg.PrismaSchemaFilePath)
 	if err != nil {
 		log.Fatalln("load prisma schema", err)
 	}
-	if config.EnableMigration {
-		migrate.Database(config.MigrationEnginePath, config.MigrationLockFilePath, string(schema), config.PrismaSchemaFilePath)
-	}
-	go queryengine.Run(ctx, wg, config.QueryEnginePath, config.QueryEnginePort, config.PrismaSchemaFilePath, config.Production)
-	log.Printf("Server Listening on: http://%s", config.ListenAddr)
-	handler := api.NewHandler(config.EnableSleepMode,
-		config.Production,
-		fmt.Sprintf("http://localhost:%s/", config.QueryEnginePort),
-		fmt.Sprintf("http://localhost:%s/sdl", config.QueryEnginePort),
-		config.HealthEndpoint,
-		config.SleepAfterSeconds,
-		config.ReadLimitSeconds,
-		config.WriteLimitSeconds,
-		cancel)
+	var redisClient redis.UniversalClient
+	if cfg.RedisRestAPIEnable || cfg.MigrationDistributedLock {
+		redisClient, err = newRedisClient(cfg)
+		if err != nil {
+			log.Fatalln("redis client", err)
+		}
+	}
+	var locker migrate.Locker
+	if cfg.MigrationDistributedLock {
+		locker = migrate.NewRedisLocker(redisClient, cfg.MigrationLockKey, 30*time.Second)
+	}
+	migrator := migrate.NewRunner(migrationOptions, cfg.MigrationMode, locker, time.Duration(cfg.MigrationLockWaitSeconds)*time.Second)
+	// `migrate dry-run` prints the changes a migration would apply as JSON, the pending migrations in deploy mode,
+	// it exits with 1 if they would lose data and MIGRATION_ALLOW_DATA_LOSS is not set
+	if flag.Arg(0) == "migrate" && flag.Arg(1) == "dry-run" {
+		report, err := migrator.DryRun(ctx, nil)
+		if err != nil {
+			log.Fatalln("migration dry run", err)
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(report)
+		if err != nil {
+			log.Fatalln("print migration dry run", err)
+		}
+		if report.Destructive && !cfg.MigrationAllowDataLoss {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	var migrationErr error
+	if cfg.EnableMigration {
+		var status *migrate.Status
+		status, migrationErr = migrator.Migrate(ctx, nil)
+		if status != nil {
+			logMigration(status)
+		}
+		if migrationErr != nil && cfg.MigrationFailurePolicy == "degraded" {
+			log.Println("Migration failed, serving in degraded mode:", migrationErr)
+		} else if migrationErr != nil {
+			log.Fatalln("Migration failed:", migrationErr)
+		}
+	}
+	engineConfig := queryengine.Config{
+		QueryEnginePath:           cfg.QueryEnginePath,
+		QueryEnginePort:           cfg.QueryEnginePort,
+		PrismaSchemaFilePath:      cfg.PrismaSchemaFilePath,
+		Production:                cfg.Production,
+		HostBind:                  cfg.QueryEngineHostBind,
+		EnableRawQueries:          cfg.EnableRawQueries,
+		EnableLog:                 cfg.QueryEngineLog,
+		EnableMetrics:             cfg.EnableMetrics,
+		EnableOpenTelemetry:       cfg.EnableOpenTelemetry,
+		OpenTelemetryEndpoint:     cfg.OpenTelemetryEndpoint,
+		EnableTelemetryInResponse: cfg.EnableTelemetryInResponse,
+	}
+	managerOptions := queryengine.ManagerOptions{
+		Config:      engineConfig,
+		StandbyPort: cfg.StandbyPort(),
+		Timeout:     time.Duration(cfg.SchemaReloadTimeoutSeconds) * time.Second,
+	}
+	if cfg.SchemaReloadMigrate {
+		managerOptions.Migrator = migrator
+	}
+	manager := queryengine.NewManager(managerOptions)
+	engine, err := manager.Start()
+	if err != nil {
+		log.Fatalln("start query engine", err)
+	}
+	options := api.Options{
+		ApiKey:                   cfg.ApiKey,
+		EnableSleepMode:          cfg.EnableSleepMode,
+		Production:               cfg.Production,
+		QueryEngineURL:           fmt.Sprintf("http://localhost:%s/", cfg.QueryEnginePort),
+		QueryEngineSdlURL:        fmt.Sprintf("http://localhost:%s/sdl", cfg.QueryEnginePort),
+		HealthEndpoint:           cfg.HealthEndpoint,
+		MetricsEndpoint:          cfg.MetricsEndpoint,
+		SleepAfterSeconds:        cfg.SleepAfterSeconds,
+		ReadLimitSeconds:         cfg.ReadLimitSeconds,
+		WriteLimitSeconds:        cfg.WriteLimitSeconds,
+		Engine:                   engine,
+		SchemaHash:               manager.SchemaHash(),
+		EngineGracePeriodSeconds: cfg.QueryEngineGracePeriodSeconds,
+		AdminApiKey:              cfg.AdminApiKey,
+		Migrator:                 migrator,
+		Reloader:                 manager,
+	}
+	if cfg.RedisRestAPIEnable {
+		log.Println("Redis Enabled")
+		options.Redis = redisClient
+		options.RedisHealthCheck = cfg.RedisHealthCheck
+		options.RedisScriptsKey = cfg.RedisScriptsKey
+		options.RedisReservedKeys = []string{cfg.MigrationLockKey, cfg.MigrationLockKey + ":completed"}
+		options.RedisCommandTimeoutSeconds = cfg.RedisCommandTimeoutSeconds
+		options.RedisAllowBlockingCommands = cfg.RedisAllowBlockingCommands
+		options.RedisSlowCommandThresholdMs = cfg.RedisSlowCommandThresholdMs
+		options.RedisScopes = cfg.RedisScopes()
+		options.RedisApiKeys, err = cfg.RedisKeys()
+		if err != nil {
+			log.Fatalln("redis api keys", err)
+		}
+		options.RedisKeyPrefixes, err = cfg.RedisPrefixes()
+		if err != nil {
+			log.Fatalln("redis key prefixes", err)
+		}
+		options.RedisAllowedCommands = cfg.RedisAllowedCommands
+		options.RedisDeniedCommands = cfg.RedisDeniedCommands
+	}
+	log.Printf("Server Listening on: http://%s", cfg.ListenAddr)
+	handler := api.NewHandler(options)
+	if migrationErr != nil {
+		handler.SetDegraded("migration failed: " + migrationErr.Error())
+	}
+	manager.SetSwitch(func(ctx context.Context, engine *queryengine.Engine, schemaHash, url, sdlURL string) error {
+		return handler.SwitchEngine(ctx, engine, schemaHash, url, sdlURL)
+	}, func(ctx context.Context, engine *queryengine.Engine) {
+		handler.RetireEngine(ctx, engine)
+	})
+	if cfg.SchemaWatchIntervalSeconds > 0 {
+		go manager.Watch(ctx, time.Duration(cfg.SchemaWatchIntervalSeconds)*time.Second)
+	}
+	if cfg.SchemaDriftCheckIntervalSeconds > 0 {
+		interval := time.Duration(cfg.SchemaDriftCheckIntervalSeconds) * time.Second
+		detector := migrate.NewDriftDetector(migrationOptions, interval, handler.SetDrift)
+		go detector.Run(ctx)
+	}
 	srv := http.Server{
-		Addr:    config.ListenAddr,
+		Addr:    cfg.ListenAddr,
 		Handler: handler,
 	}
 	go func() {
@@ -109,12 +200,90 @@ func main() {
 		}
 	}()
 	<-ctx.Done()
-	err = srv.Close()
+	// a second SIGINT or SIGTERM exits right away
+	stop()
+	log.Println("Shutting down, draining in-flight requests")
+	// the open transactions and the in-flight requests share the drain timeout
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), time.Duration(cfg.DrainTimeoutSeconds)*time.Second)
+	defer cancelDrain()
+	handler.Drain(drainCtx)
+	err = srv.Shutdown(drainCtx)
 	if err != nil {
-		log.Fatalln("close server", err)
+		log.Println("shutdown server", err)
+		err = srv.Close()
+		if err != nil {
+			log.Fatalln("close server", err)
+		}
 	}
 	log.Println("Server stopped")
-	wg.Done()
-	wg.Wait()
+	// the query engine is stopped only after the server is drained
+	manager.Stop()
 	os.Exit(0)
 }
+
+// logMigration logs the outcome of a migration
+func logMigration(status *migrate.Status) {
+	switch result := status.Result.(type) {
+	case *migrate.ApplyResult:
+		log.Printf("Migrations applied: %v, already applied: %v", result.Applied, result.AlreadyApplied)
+		if result.Failed != "" {
+			log.Printf("Migration %s failed", result.Failed)
+		}
+	case *migrate.Result:
+		if !result.Skipped {
+			log.Printf("Migration executed %d steps", result.ExecutedSteps)
+		}
+	}
+}
+
+// newRedisClient creates a single node, sentinel or cluster client depending on REDIS_MODE
+func newRedisClient(cfg *config.Config) (redis.UniversalClient, error) {
+	options := &redis.UniversalOptions{
+		Addrs:            cfg.RedisAddresses(),
+		DB:               cfg.RedisDB,
+		Username:         cfg.RedisUsername,
+		Password:         cfg.RedisPassword,
+		SentinelPassword: cfg.RedisSentinelPassword,
+		MasterName:       cfg.RedisSentinelMasterName,
+		PoolSize:         cfg.RedisPoolSize,
+		MinIdleConns:     cfg.RedisMinIdleConns,
+		// the REST API limits its commands with the deadline of their context,
+		// the read timeout must not end blocking commands before
+		ReadTimeout: time.Duration(cfg.RedisCommandTimeoutSeconds) * time.Second,
+	}
+	if cfg.RedisAllowBlockingCommands {
+		options.ReadTimeout = -1
+	}
+	if cfg.RedisTLSEnable {
+		tlsConfig := &tls.Config{
+			MinVersion:         tls.VersionTLS12,
+			InsecureSkipVerify: cfg.RedisTLSInsecureSkipVerify,
+		}
+		if cfg.RedisTLSCAFile != "" {
+			ca, err := ioutil.ReadFile(cfg.RedisTLSCAFile)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+				return nil, fmt.Errorf("no certificates found in %s", cfg.RedisTLSCAFile)
+			}
+		}
+		if cfg.RedisTLSCertFile != "" {
+			cert, err := tls.LoadX509KeyPair(cfg.RedisTLSCertFile, cfg.RedisTLSKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		options.TLSConfig = tlsConfig
+	}
+	switch cfg.RedisMode {
+	case "sentinel":
+		return redis.NewFailoverClient(options.Failover()), nil
+	case "cluster":
+		return redis.NewClusterClient(options.Cluster()), nil
+	default:
+		return redis.NewClient(options.Simple()), nil
+	}
+}
@@ -0,0 +1,142 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"wunderbase/pkg/migrate"
+	"wunderbase/pkg/queryengine"
+)
+
+// Migrator runs migrations for the admin API, it is implemented by *migrate.Runner
+type Migrator interface {
+	Migrate(ctx context.Context, onLog func(migrate.LogLine)) (*migrate.Status, error)
+	DryRun(ctx context.Context, onLog func(migrate.LogLine)) (*migrate.DiffReport, error)
+	Status() *migrate.Status
+}
+
+// Reloader replaces the query engine after schema.prisma changed, it is implemented by *queryengine.Manager
+type Reloader interface {
+	Reload(ctx context.Context) (*queryengine.ReloadResult, error)
+}
+
+// serveAdmin serves the admin endpoints, which are authenticated with the admin API key:
+//
+//	POST /admin/migrate          runs a migration
+//	POST /admin/migrate/dry-run  reports what a migration would change
+//	GET  /admin/migrate/status   returns the status of the running or last migration
+//	POST /admin/reload           reloads schema.prisma into a new query engine
+//	/admin/redis/scripts         manages the named scripts of the Redis REST API, see adminRedisScripts
+//
+// With "Accept: application/x-ndjson" the migration engine logs are streamed
+// as {"log":{...}} lines, followed by a {"result":{...}} or {"error":"..."} line.
+func (h *Handler) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	if h.adminApiKey == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Header.Get("authorization") != "Bearer "+h.adminApiKey {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case r.URL.Path == "/admin/reload" && r.Method == http.MethodPost && h.reloader != nil:
+		result, err := h.reloader.Reload(context.Background())
+		switch {
+		case errors.Is(err, queryengine.ErrReloadInProgress):
+			writeJSON(w, http.StatusConflict, adminEvent{Error: err.Error()})
+		case err != nil:
+			writeJSON(w, http.StatusInternalServerError, adminEvent{Result: result, Error: err.Error()})
+		default:
+			writeJSON(w, http.StatusOK, result)
+		}
+	case strings.HasPrefix(r.URL.Path, "/admin/redis/scripts") && h.redis != nil:
+		h.adminRedisScripts(w, r)
+	case h.migrator == nil:
+		w.WriteHeader(http.StatusNotFound)
+	case r.URL.Path == "/admin/migrate" && r.Method == http.MethodPost:
+		h.adminRun(w, r, func(onLog func(migrate.LogLine)) (interface{}, error) {
+			// the migration is not cancelled if the client disconnects
+			status, err := h.migrator.Migrate(context.Background(), onLog)
+			if status == nil {
+				return nil, err
+			}
+			return status, err
+		})
+	case r.URL.Path == "/admin/migrate/dry-run" && r.Method == http.MethodPost:
+		h.adminRun(w, r, func(onLog func(migrate.LogLine)) (interface{}, error) {
+			report, err := h.migrator.DryRun(r.Context(), onLog)
+			if report == nil {
+				return nil, err
+			}
+			return report, err
+		})
+	case r.URL.Path == "/admin/migrate/status" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, h.migrator.Status())
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+type adminEvent struct {
+	Log    *migrate.LogLine `json:"log,omitempty"`
+	Result interface{}      `json:"result,omitempty"`
+	Error  string           `json:"error,omitempty"`
+}
+
+// adminRun responds with the result of run.
+// run returns a nil interface without a result, so the event has no "result" field.
+func (h *Handler) adminRun(w http.ResponseWriter, r *http.Request, run func(onLog func(migrate.LogLine)) (interface{}, error)) {
+	if !strings.Contains(r.Header.Get("Accept"), "application/x-ndjson") {
+		result, err := run(nil)
+		switch {
+		case errors.Is(err, migrate.ErrInProgress):
+			writeJSON(w, http.StatusConflict, adminEvent{Error: err.Error()})
+		case err != nil:
+			writeJSON(w, http.StatusInternalServerError, adminEvent{Result: result, Error: err.Error()})
+		default:
+			writeJSON(w, http.StatusOK, result)
+		}
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	mu := &sync.Mutex{}
+	started := false
+	// the status is sent with the first event, so a migration that is already running gets a 409 like without streaming
+	send := func(status int, event adminEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !started {
+			started = true
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.WriteHeader(status)
+		}
+		_ = encoder.Encode(event)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	result, err := run(func(line migrate.LogLine) {
+		send(http.StatusOK, adminEvent{Log: &line})
+	})
+	switch {
+	case errors.Is(err, migrate.ErrInProgress):
+		send(http.StatusConflict, adminEvent{Error: err.Error()})
+	case err != nil:
+		send(http.StatusOK, adminEvent{Result: result, Error: err.Error()})
+	default:
+		send(http.StatusOK, adminEvent{Result: result})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
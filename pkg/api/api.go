@@ -3,189 +3,314 @@ package api
 import (
 	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"wunderbase/pkg/graphiql"
+	"wunderbase/pkg/metrics"
+	"wunderbase/pkg/migrate"
 
 	"github.com/buger/jsonparser"
-	"github.com/wundergraph/graphql-go-tools/pkg/astparser"
-	"github.com/wundergraph/graphql-go-tools/pkg/asttransform"
 	"github.com/wundergraph/graphql-go-tools/pkg/introspection"
 	"go.uber.org/ratelimit"
-
-	"github.com/go-redis/redis/v8"
 )
 
-var AdditionalConfig struct {
-	ApiKey               string
-	EnableRawQueries     bool
-	EnableQueryEngineLog bool
-	EnableMetrics bool
-	QueryEngineHostBind string
-	EnableOpenTelemetry bool
-	OpenTelemetryEndpoint string
-	EnableTelemetryInResponse bool
-}
-
-var RedisConfig struct {
-	RedisEnable   bool
-	RedisAddress  string
-	RedisPassword string
-	RedisDB       int
+// Options configures a Handler
+type Options struct {
+	ApiKey            string
+	EnableSleepMode   bool
+	Production        bool
+	QueryEngineURL    string
+	QueryEngineSdlURL string
+	HealthEndpoint    string
+	MetricsEndpoint   string
+	SleepAfterSeconds int
+	ReadLimitSeconds  int
+	WriteLimitSeconds int
+	// Engine is stopped and started by sleep mode, it may be nil if sleep mode is disabled
+	Engine Engine
+	// SchemaHash is the hash Prisma clients of the engine's schema send in the request path
+	SchemaHash string
+	// EngineGracePeriodSeconds keeps the previous engine serving clients of its schema after SwitchEngine,
+	// until it wasn't used for this long
+	EngineGracePeriodSeconds int
+	// Redis serves the /redis REST API, nil disables it
+	Redis RedisClient
+	// RedisHealthCheck reports the proxy as unhealthy on the health endpoint while Redis is unreachable
+	RedisHealthCheck bool
+	// RedisScopes are the command scopes of ApiKey for the Redis REST API, all scopes if nil
+	RedisScopes []string
+	// RedisApiKeys are additional API keys that may only use the Redis REST API, with their scopes
+	RedisApiKeys map[string][]string
+	// RedisAllowedCommands restricts the Redis REST API to these commands if not empty
+	RedisAllowedCommands []string
+	// RedisDeniedCommands are never executed by the Redis REST API
+	RedisDeniedCommands []string
+	// RedisCommandTimeoutSeconds is the max duration of the Redis commands of a request, 10 if 0
+	RedisCommandTimeoutSeconds int
+	// RedisAllowBlockingCommands allows blocking commands that wait longer than the command timeout
+	RedisAllowBlockingCommands bool
+	// RedisScriptsKey is the Redis hash of the scripts registered with the admin API, "wunderbase:scripts" if empty
+	RedisScriptsKey string
+	// RedisReservedKeys are used by the proxy itself, e.g. the migration lock, the Redis REST API rejects them like RedisScriptsKey
+	RedisReservedKeys []string
+	// RedisKeyPrefixes are added to the Redis keys of the API keys, so they can't use each other's keys
+	RedisKeyPrefixes map[string]string
+	// RedisSlowCommandThresholdMs logs the Redis commands that take at least this long, 0 disables the log
+	RedisSlowCommandThresholdMs int
+	// AdminApiKey authenticates the /admin endpoints, they are disabled if it is empty
+	AdminApiKey string
+	// Migrator runs the migrations triggered by the /admin endpoints
+	Migrator Migrator
+	// Reloader reloads schema.prisma for the /admin/reload endpoint
+	Reloader Reloader
 }
 
-var rdb *redis.Client
-
 type Handler struct {
+	apiKey            string
 	enableSleepMode   bool
 	enablePlayground  bool
-	queryEngineURL    string
-	queryEngineSdlURL string
 	healthEndpoint    string
+	metricsEndpoint   string
 	sleepAfterSeconds int
 	init              sync.Once
-	sleepCh           chan struct{}
 	client            *http.Client
 	readLimit         ratelimit.Limiter
 	writeLimit        ratelimit.Limiter
-	cancel            func()
+	backendMu         sync.RWMutex
+	backend           *backend
+	previous          []*backend
+	engineGracePeriod time.Duration
+	redis             RedisClient
+	redisACL          *redisACL
+	redisPrefixes     map[string]string
+	redisHealthCheck  bool
+	redisScripts      *scriptCache
+	redisTimeout      time.Duration
+	allowBlocking     bool
+	redisScriptsKey   string
+	redisReserved     map[string]bool
+	redisMetrics      *redisMetrics
+	adminApiKey       string
+	migrator          Migrator
+	reloader          Reloader
+	asleep            bool
+	waking            *wakeup
+	stopping          chan struct{}
+	inFlight          int
+	lastActive        time.Time
+	idleTimer         *time.Timer
+	sleepMu           sync.Mutex
+	transactions      *transactions
+	draining          int32
+	drainOnce         sync.Once
+	drained           chan struct{}
+	degraded          atomic.Value
+	drift             atomic.Value
+	metrics           *metrics.Registry
+	coldStarts        *metrics.Counter
+	coldStartSeconds  *metrics.Histogram
+	schemaDrift       *metrics.Gauge
+	driftDifferences  *metrics.Gauge
+	driftCheckErrors  *metrics.Counter
 }
 
-func NewHandler(enableSleepMode bool, production bool, queryEngineURL string, queryEngineSdlURL, healthEndpoint string, sleepAfterSeconds, readLimitSeconds, writeLimitSeconds int, cancel func()) *Handler {
-	if RedisConfig.RedisEnable {
-		fmt.Println("Redis Enabled")
-		rdb = redis.NewClient(&redis.Options{
-			Addr:     RedisConfig.RedisAddress,
-			Password: RedisConfig.RedisPassword,
-			DB:       RedisConfig.RedisDB,
-		})
+// NewHandler creates the proxy handler in front of the query engine
+func NewHandler(options Options) *Handler {
+	registry := metrics.NewRegistry()
+	redisKeys := map[string][]string{}
+	for key, scopes := range options.RedisApiKeys {
+		redisKeys[key] = scopes
+	}
+	redisKeys[options.ApiKey] = options.RedisScopes
+	if options.RedisScopes == nil {
+		redisKeys[options.ApiKey] = RedisScopes
+	}
+	redisTimeout := time.Duration(options.RedisCommandTimeoutSeconds) * time.Second
+	if redisTimeout == 0 {
+		redisTimeout = 10 * time.Second
+	}
+	redisScriptsKey := options.RedisScriptsKey
+	if redisScriptsKey == "" {
+		redisScriptsKey = "wunderbase:scripts"
+	}
+	redisReserved := map[string]bool{redisScriptsKey: true}
+	for _, key := range options.RedisReservedKeys {
+		redisReserved[key] = true
+	}
+	// the Redis metrics are only exported if the Redis REST API is enabled
+	var redisUsage *redisMetrics
+	if options.Redis != nil {
+		redisUsage = newRedisMetrics(registry, options.ApiKey,
+			time.Duration(options.RedisSlowCommandThresholdMs)*time.Millisecond)
 	}
 
 	return &Handler{
-		enableSleepMode:   enableSleepMode,
-		enablePlayground:  !production,
-		queryEngineURL:    queryEngineURL,
-		queryEngineSdlURL: queryEngineSdlURL,
-		healthEndpoint:    healthEndpoint,
-		sleepCh:           make(chan struct{}),
-		sleepAfterSeconds: sleepAfterSeconds,
+		apiKey:            options.ApiKey,
+		enableSleepMode:   options.EnableSleepMode,
+		enablePlayground:  !options.Production,
+		healthEndpoint:    options.HealthEndpoint,
+		metricsEndpoint:   options.MetricsEndpoint,
+		sleepAfterSeconds: options.SleepAfterSeconds,
 		client: &http.Client{
 			Timeout: 5 * time.Second,
 		},
-		readLimit:  ratelimit.New(readLimitSeconds),
-		writeLimit: ratelimit.New(writeLimitSeconds),
-		cancel:     cancel,
+		readLimit:         ratelimit.New(options.ReadLimitSeconds),
+		writeLimit:        ratelimit.New(options.WriteLimitSeconds),
+		backend:           newBackend(options.Engine, options.SchemaHash, options.QueryEngineURL, options.QueryEngineSdlURL),
+		engineGracePeriod: time.Duration(options.EngineGracePeriodSeconds) * time.Second,
+		redis:             options.Redis,
+		redisACL:          newRedisACL(redisKeys, options.RedisAllowedCommands, options.RedisDeniedCommands),
+		redisPrefixes:     options.RedisKeyPrefixes,
+		redisHealthCheck:  options.RedisHealthCheck,
+		redisScripts:      newScriptCache(),
+		redisTimeout:      redisTimeout,
+		allowBlocking:     options.RedisAllowBlockingCommands,
+		redisScriptsKey:   redisScriptsKey,
+		redisReserved:     redisReserved,
+		redisMetrics:      redisUsage,
+		adminApiKey:       options.AdminApiKey,
+		migrator:          options.Migrator,
+		reloader:          options.Reloader,
+		transactions:      newTransactions(),
+		drained:           make(chan struct{}),
+		metrics:           registry,
+		coldStarts: registry.Counter("wunderbase_engine_cold_starts_total",
+			"Number of times the query engine was woken up from sleep mode."),
+		coldStartSeconds: registry.Histogram("wunderbase_engine_cold_start_seconds",
+			"Time from waking up the query engine until it was ready to serve requests.",
+			[]float64{.1, .25, .5, 1, 2.5, 5, 10, 30}),
+		schemaDrift: registry.Gauge("wunderbase_schema_drift",
+			"1 if the live database differs from the loaded Prisma schema, 0 otherwise."),
+		driftDifferences: registry.Gauge("wunderbase_schema_drift_differences",
+			"Number of migration steps between the live database and the loaded Prisma schema."),
+		driftCheckErrors: registry.Counter("wunderbase_schema_drift_check_errors_total",
+			"Number of schema drift checks that failed."),
 	}
 }
 
+// Metrics returns the registry of the proxy metrics served on the metrics endpoint
+func (h *Handler) Metrics() *metrics.Registry {
+	return h.metrics
+}
+
 type IntrospectionResponse struct {
 	Data introspection.Data `json:"data"`
 }
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
+	// the admin endpoints have their own API key
+	if strings.HasPrefix(r.URL.Path, "/admin/") {
+		h.serveAdmin(w, r)
+		return
+	}
+
 	apiKeyFromQueryString := r.URL.Query().Get("api_key")
 	if apiKeyFromQueryString == "" {
 		apiKeyFromQueryString = r.URL.Query().Get("_token")
 	}
 	apiKeyFromHeader := r.Header.Get("authorization")
 
-	if apiKeyFromQueryString != AdditionalConfig.ApiKey && apiKeyFromHeader != "Bearer "+AdditionalConfig.ApiKey {
+	// the Redis API keys are checked for their scopes by serveRedis
+	isRedisKey := h.redis != nil && strings.HasPrefix(r.URL.Path, "/redis") && h.redisACL.isKey(requestApiKey(r))
+
+	if apiKeyFromQueryString != h.apiKey && apiKeyFromHeader != "Bearer "+h.apiKey && !isRedisKey {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
 	h.init.Do(func() {
-		if h.enableSleepMode {
-			go h.runSleepMode()
-		}
-		for {
-			resp, err := http.Get(h.queryEngineURL)
-			if err != nil || resp.StatusCode != http.StatusOK {
-				time.Sleep(3 * time.Millisecond)
-				continue
-			}
-			break
-		}
+		_ = h.waitForEngine(context.Background(), h.current().url)
 	})
 
-	if RedisConfig.RedisEnable && strings.HasPrefix(r.URL.Path, "/redis") {
-
-		var arr []interface{}
+	if r.URL.Path == h.metricsEndpoint {
+		w.Header().Add("Content-Type", "text/plain; version=0.0.4")
+		h.metrics.WritePrometheus(w)
+		return
+	}
 
-		if r.Method == "POST" {
-			err := json.NewDecoder(r.Body).Decode(&arr)
+	if r.URL.Path == h.healthEndpoint {
+		// explicitly do this before the sleep mode check
+		// otherwise the sleep mode will never be triggered
+		if h.isDraining() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("draining"))
+			return
+		}
+		if h.redis != nil && h.redisHealthCheck {
+			ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+			err := h.redis.Do(ctx, "PING").Err()
+			cancel()
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusBadRequest)
+				w.WriteHeader(http.StatusInternalServerError)
+				_, _ = w.Write([]byte("redis not reachable"))
 				return
 			}
 		}
-		if r.Method == "GET" {
-			// /redis/set/key/value => ["SET", "key", "value"]
-			parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/redis/"), "/")
-			for _, part := range parts {
-				arr = append(arr, part)
+		var notes []string
+		if h.isAsleep() {
+			// the engine is started again by the next request
+			notes = append(notes, "sleeping")
+		} else {
+			resp, err := http.Get(h.current().url)
+			if err == nil {
+				_ = resp.Body.Close()
 			}
-		}
-
-		w.Header().Add("Content-Type", "application/json")
-
-		ctx, cancel := context.WithCancel(context.Background())
-		defer cancel()
-		result, err := rdb.Do(ctx, arr...).Result()
-
-		var jsonResult []byte
-		if err != nil {
-			if err.Error() == "redis: nil" {
-				jsonResult, _ = json.Marshal(map[string]interface{}{
-					"result": nil,
-				})
-				w.WriteHeader(http.StatusOK)
-			} else {
-				jsonResult, _ = json.Marshal(map[string]interface{}{
-					"error": err.Error(),
-				})
-				w.WriteHeader(http.StatusBadRequest)
+			if err != nil || resp.StatusCode != http.StatusOK {
+				w.WriteHeader(http.StatusInternalServerError)
+				_, _ = w.Write([]byte("query engine not reachable"))
+				return
 			}
-		} else {
-			jsonResult, _ = json.Marshal(map[string]interface{}{
-				"result": result,
-			})
-			w.WriteHeader(http.StatusOK)
 		}
+		// the degraded state annotates a passing check, traffic is still served
+		if reason, _ := h.degraded.Load().(string); reason != "" {
+			notes = append(notes, "degraded: "+reason)
+		}
+		// drift doesn't stop the proxy, queries touching the changed tables may fail
+		if drift, _ := h.drift.Load().(*migrate.DriftStatus); drift != nil && drift.Drifted {
+			notes = append(notes, fmt.Sprintf("schema drift: %d differences", len(drift.Differences)))
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(healthStatus(notes)))
+		return
+	}
 
-		_, _ = w.Write(jsonResult)
+	if h.isDraining() && !h.transactions.isOpen(transactionID(r)) {
+		// only requests of interactive transactions that are still open
+		// are accepted while draining, so they are able to commit
+		w.Header().Set("Connection", "close")
+		w.WriteHeader(http.StatusServiceUnavailable)
 		return
 	}
 
-	if r.URL.Path == h.healthEndpoint {
-		// explicitly do this before the sleep mode check
-		// otherwise the sleep mode will never be triggered
-		resp, err := http.Get(h.queryEngineURL)
-		if err != nil || resp.StatusCode != http.StatusOK {
-			w.WriteHeader(http.StatusInternalServerError)
-			_, _ = w.Write([]byte("query engine not reachable"))
-			return
-		}
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte("OK"))
+	if h.enableSleepMode {
+		// the query engine never sleeps while requests are in flight
+		h.begin()
+		defer h.end()
+	}
+
+	if h.redis != nil && strings.HasPrefix(r.URL.Path, "/redis") {
+		h.serveRedis(w, r)
 		return
 	}
 
 	if h.enableSleepMode {
-		defer func() {
-			h.sleepCh <- struct{}{}
-		}()
+		err := h.wake(r.Context())
+		if err != nil {
+			log.Println("wake query engine", err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
 	}
 
-	if h.enablePlayground && r.Header.Get("Content-Type") != "application/json" && !strings.Contains(r.UserAgent(), "Deno"){
+	if h.enablePlayground && r.Header.Get("Content-Type") != "application/json" && !strings.Contains(r.UserAgent(), "Deno") {
 		w.Header().Add("Content-Type", "text/html")
 		html := graphiql.GetGraphiqlPlaygroundHTML(r.RequestURI)
 		_, _ = w.Write([]byte(html))
@@ -193,43 +318,42 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		log.Fatalln(err)
+		// e.g. the client disconnected while sending the body
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	// requests stay on the engine they started with if the engine is switched meanwhile
+	b := h.acquire(r)
+	defer h.release(b)
+	if path, ok := transactionPath(r.URL.Path); ok {
+		h.proxyTransaction(b, path, body, w, r)
+		return
 	}
 	// check if body is introspection query
 	if bytes.Contains(body, []byte("IntrospectionQuery")) {
-		// if so, return the schema
-		w.Header().Add("Content-Type", "application/json")
-		gen := introspection.NewGenerator()
-		// get the schema from the query engine on /sdl endpoint
-		resp, err := http.Get(h.queryEngineSdlURL)
+		// if so, return the schema, the introspection result is cached per engine
+		result, err := b.introspect()
 		if err != nil {
-			log.Fatalln(err)
-		}
-		defer resp.Body.Close()
-		schemaSDL, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			log.Fatalln(err)
-		}
-		// generate the introspection result from the schema
-		doc, report := astparser.ParseGraphqlDocumentBytes(schemaSDL)
-		err = asttransform.MergeDefinitionWithBaseSchema(&doc)
-		if err != nil {
-			log.Fatalln(err)
-		}
-		var response IntrospectionResponse
-		gen.Generate(&doc, &report, &response.Data)
-		// marshal the result
-		b, err := json.Marshal(response)
-		if err != nil {
-			log.Fatalln(err)
+			log.Println("introspection", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
 		}
-		_, _ = w.Write(b)
+		w.Header().Add("Content-Type", "application/json")
+		_, _ = w.Write(result)
 		return
 	}
-	h.proxyRequestToEngine(body, w, r)
+	h.proxyRequestToEngine(b, body, w, r)
+}
+
+// healthStatus is the body of a passing health check, with its notes in parentheses
+func healthStatus(notes []string) string {
+	if len(notes) == 0 {
+		return "OK"
+	}
+	return "OK (" + strings.Join(notes, ", ") + ")"
 }
 
-func (h *Handler) proxyRequestToEngine(body []byte, w http.ResponseWriter, r *http.Request) {
+func (h *Handler) proxyRequestToEngine(b *backend, body []byte, w http.ResponseWriter, r *http.Request) {
 	variables, _, _, _ := jsonparser.Get(body, "variables")
 	if variables == nil {
 		// if no variables are set, set an empty object
@@ -241,27 +365,42 @@ func (h *Handler) proxyRequestToEngine(body []byte, w http.ResponseWriter, r *ht
 		body, _ = jsonparser.Set(body, []byte("null"), "operationName")
 	}
 	for i := 0; i < 3; i++ {
-		if h.sendRequest(body, w, r) {
+		if h.sendRequest(b, body, w, r) {
 			return
 		}
 	}
 	w.WriteHeader(http.StatusInternalServerError)
 }
 
-func (h *Handler) sendRequest(body []byte, w http.ResponseWriter, r *http.Request) bool {
+// requestApiKey returns the API key of r from the authorization header,
+// or from the api_key or _token query parameter
+func requestApiKey(r *http.Request) string {
+	if key := strings.TrimPrefix(r.Header.Get("authorization"), "Bearer "); key != "" {
+		return key
+	}
+	if key := r.URL.Query().Get("api_key"); key != "" {
+		return key
+	}
+	return r.URL.Query().Get("_token")
+}
+
+func (h *Handler) sendRequest(b *backend, body []byte, w http.ResponseWriter, r *http.Request) bool {
 
 	if bytes.Contains(body, []byte("mutation")) {
 		h.writeLimit.Take()
 	}
 	h.readLimit.Take()
 
-	newRequest, err := http.NewRequestWithContext(r.Context(), r.Method, h.queryEngineURL, ioutil.NopCloser(bytes.NewBuffer(body)))
+	newRequest, err := http.NewRequestWithContext(r.Context(), r.Method, b.url, ioutil.NopCloser(bytes.NewBuffer(body)))
 	if err != nil {
 		log.Println(err)
 		return false
 	}
 	// set the content type to application/json
 	newRequest.Header.Set("content-type", "application/json")
+	if id := r.Header.Get("X-transaction-id"); id != "" {
+		newRequest.Header.Set("X-transaction-id", id)
+	}
 	resp, err := h.client.Do(newRequest)
 	if err != nil || resp.StatusCode != http.StatusOK {
 		return false
@@ -284,22 +423,59 @@ func (h *Handler) sendRequest(body []byte, w http.ResponseWriter, r *http.Reques
 	return true
 }
 
-func (h *Handler) runSleepMode() {
-	timer := time.NewTimer(time.Duration(h.sleepAfterSeconds) * time.Second)
-	defer func() {
-		fmt.Println("No requests for", h.sleepAfterSeconds, "seconds, cancelling context")
-		h.cancel()
-		return
-	}()
+// Drain stops accepting new requests and waits until all open interactive transactions
+// are committed or rolled back, or until ctx is done.
+// In-flight requests are drained by http.Server.Shutdown afterwards.
+func (h *Handler) Drain(ctx context.Context) {
+	atomic.StoreInt32(&h.draining, 1)
+	// ends the event streams, clients reconnect to another replica
+	h.drainOnce.Do(func() {
+		close(h.drained)
+	})
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
 	for {
+		open := h.transactions.count()
+		if open == 0 {
+			return
+		}
 		select {
-		case <-h.sleepCh:
-			done := timer.Reset(time.Duration(h.sleepAfterSeconds) * time.Second)
-			if !done {
-				return
-			}
-		case <-timer.C:
+		case <-ctx.Done():
+			log.Printf("Drain timeout reached, abandoning %d open transactions", open)
 			return
+		case <-ticker.C:
 		}
 	}
 }
+
+// SetDegraded marks the proxy as degraded, e.g. after a failed migration.
+// Requests are still served and the reason is reported on the health endpoint.
+func (h *Handler) SetDegraded(reason string) {
+	h.degraded.Store(reason)
+}
+
+// SetDrift records the result of a schema drift check,
+// drift is reported on the health endpoint and as a metric
+func (h *Handler) SetDrift(status *migrate.DriftStatus) {
+	h.drift.Store(status)
+	if status.Error != "" {
+		logMetric(h.driftCheckErrors.Inc())
+	}
+	drifted := 0.0
+	if status.Drifted {
+		drifted = 1
+	}
+	logMetric(h.schemaDrift.Set(drifted))
+	logMetric(h.driftDifferences.Set(float64(len(status.Differences))))
+}
+
+// logMetric logs the error of updating a metric, it is not worth failing the request for
+func logMetric(err error) {
+	if err != nil {
+		log.Println("update metric", err)
+	}
+}
+
+func (h *Handler) isDraining() bool {
+	return atomic.LoadInt32(&h.draining) == 1
+}
@@ -2,34 +2,503 @@ package api
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/gavv/httpexpect/v2"
+	"github.com/stretchr/testify/require"
+
+	"wunderbase/pkg/migrate"
 )
 
-func TestApi(t *testing.T) {
-	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-	}))
+// newFakeDB serves handler as the query engine until the end of the test
+func newFakeDB(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	fakeDB := httptest.NewServer(handler)
+	t.Cleanup(fakeDB.Close)
+	return fakeDB
+}
 
-	_, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	handler := NewHandler(false, false, fakeDB.URL, fakeDB.URL+"/sdl", "/health", 0, 10000, 2000, cancel)
+// newUpDB serves a query engine that is reachable while up is 1
+func newUpDB(t *testing.T, up *int32) *httptest.Server {
+	return newFakeDB(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(up) == 0 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
 
+// newTestAPI serves a handler in front of the query engine fakeDB until the end of the test
+// and returns it with a client and the URL of the proxy.
+// fakeDB may be nil if the test doesn't reach the query engine.
+func newTestAPI(t *testing.T, fakeDB *httptest.Server, options Options) (*Handler, *httpexpect.Expect, string) {
+	if fakeDB != nil {
+		options.QueryEngineURL = fakeDB.URL + "/"
+		options.QueryEngineSdlURL = fakeDB.URL + "/sdl"
+	}
+	options.HealthEndpoint = "/health"
+	options.MetricsEndpoint = "/metrics"
+	options.ReadLimitSeconds = 10000
+	options.WriteLimitSeconds = 2000
+	handler := NewHandler(options)
 	fakeAPI := httptest.NewServer(handler)
+	t.Cleanup(fakeAPI.Close)
 
-	e := httpexpect.WithConfig(httpexpect.Config{
+	return handler, httpexpect.WithConfig(httpexpect.Config{
 		BaseURL: fakeAPI.URL,
 		Client: &http.Client{
 			Jar:     httpexpect.NewJar(),
 			Timeout: time.Second * 2,
 		},
 		Reporter: httpexpect.NewRequireReporter(t),
+	}), fakeAPI.URL
+}
+
+func TestApi(t *testing.T) {
+	up := int32(1)
+	_, e, url := newTestAPI(t, newUpDB(t, &up), Options{})
+
+	e.GET(url).Expect().Status(http.StatusOK).Body().Contains("GraphQL").Contains(url)
+	e.GET(url + "/health").Expect().Status(http.StatusOK).Body().Equal("OK")
+}
+
+func TestDrain(t *testing.T) {
+	fakeDB := newFakeDB(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/transaction/start" {
+			_, _ = w.Write([]byte(`{"id":"tx1"}`))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	handler, e, _ := newTestAPI(t, fakeDB, Options{})
+
+	e.POST("/4.16.2/hash/transaction/start").WithHeader("Content-Type", "application/json").WithBytes([]byte(`{"timeout":5000}`)).
+		Expect().Status(http.StatusOK).Body().Equal(`{"id":"tx1"}`)
+
+	drained := make(chan struct{})
+	go func() {
+		handler.Drain(context.Background())
+		close(drained)
+	}()
+
+	e.GET("/health").Expect().Status(http.StatusServiceUnavailable)
+	e.POST("/").WithHeader("Content-Type", "application/json").WithBytes([]byte(`{"query":"{}"}`)).
+		Expect().Status(http.StatusServiceUnavailable)
+	e.POST("/4.16.2/hash/transaction/tx1/commit").WithHeader("Content-Type", "application/json").WithBytes([]byte(`{}`)).
+		Expect().Status(http.StatusOK)
+
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatal("drain did not finish after the transaction was committed")
+	}
+}
+
+func TestHealthDegraded(t *testing.T) {
+	up := int32(1)
+	handler, e, _ := newTestAPI(t, newUpDB(t, &up), Options{})
+
+	handler.SetDegraded("migration failed")
+	e.GET("/health").Expect().Status(http.StatusOK).Body().Equal("OK (degraded: migration failed)")
+
+	atomic.StoreInt32(&up, 0)
+	e.GET("/health").Expect().Status(http.StatusInternalServerError).Body().Equal("query engine not reachable")
+}
+
+func TestHealthDrift(t *testing.T) {
+	up := int32(1)
+	handler, e, _ := newTestAPI(t, newUpDB(t, &up), Options{})
+
+	handler.SetDrift(&migrate.DriftStatus{Drifted: true, Differences: []migrate.DiffStep{{Kind: "DropTable", SQL: `DROP TABLE "Manual";`}}})
+	e.GET("/health").Expect().Status(http.StatusOK).Body().Equal("OK (schema drift: 1 differences)")
+	e.GET("/metrics").Expect().Status(http.StatusOK).Body().Contains("wunderbase_schema_drift 1")
+	handler.SetDegraded("migration failed")
+	e.GET("/health").Expect().Status(http.StatusOK).Body().Equal("OK (degraded: migration failed, schema drift: 1 differences)")
+
+	atomic.StoreInt32(&up, 0)
+	e.GET("/health").Expect().Status(http.StatusInternalServerError).Body().Equal("query engine not reachable")
+}
+
+func TestRequestBodyError(t *testing.T) {
+	up := int32(1)
+	handler, _, _ := newTestAPI(t, newUpDB(t, &up), Options{Production: true})
+
+	r := httptest.NewRequest(http.MethodPost, "/", iotest.ErrReader(errors.New("connection reset")))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+type fakeEngine struct {
+	starts int32
+	stops  int32
+	// Stop blocks until release is closed if it is set
+	release chan struct{}
+}
+
+func (e *fakeEngine) Start() error {
+	atomic.AddInt32(&e.starts, 1)
+	return nil
+}
+
+func (e *fakeEngine) Stop() {
+	atomic.AddInt32(&e.stops, 1)
+	if e.release != nil {
+		<-e.release
+	}
+}
+
+func TestSleepMode(t *testing.T) {
+	up := int32(1)
+	engine := &fakeEngine{}
+	handler, e, _ := newTestAPI(t, newUpDB(t, &up), Options{
+		EnableSleepMode:   true,
+		Production:        true,
+		SleepAfterSeconds: 1,
+		Engine:            engine,
+	})
+
+	e.POST("/").WithHeader("Content-Type", "application/json").WithBytes([]byte(`{"query":"{}"}`)).
+		Expect().Status(http.StatusOK)
+	require.Eventually(t, handler.isAsleep, 3*time.Second, 10*time.Millisecond, "expected the query engine to be stopped after being idle")
+
+	e.GET("/health").Expect().Status(http.StatusOK).Body().Equal("OK (sleeping)")
+	require.Equal(t, int32(1), atomic.LoadInt32(&engine.stops))
+
+	e.POST("/").WithHeader("Content-Type", "application/json").WithBytes([]byte(`{"query":"{}"}`)).
+		Expect().Status(http.StatusOK)
+	require.Equal(t, int32(1), atomic.LoadInt32(&engine.starts), "expected the query engine to be started by the next request")
+	e.GET("/health").Expect().Status(http.StatusOK).Body().Equal("OK")
+	e.GET("/metrics").Expect().Status(http.StatusOK).Body().Contains("wunderbase_engine_cold_starts_total 1")
+}
+
+func TestSleepModeLongRequest(t *testing.T) {
+	received, release := make(chan struct{}), make(chan struct{})
+	fakeDB := newFakeDB(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			close(received)
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	engine := &fakeEngine{}
+	handler, e, _ := newTestAPI(t, fakeDB, Options{
+		EnableSleepMode:   true,
+		Production:        true,
+		SleepAfterSeconds: 1,
+		Engine:            engine,
+	})
+
+	// arms the idle timer
+	e.GET("/").Expect().Status(http.StatusOK)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.POST("/").WithHeader("Content-Type", "application/json").WithBytes([]byte(`{"query":"{}"}`)).
+			Expect().Status(http.StatusOK)
+	}()
+	<-received
+	// the idle timeout passed, but a request is in flight
+	forceSleep(handler)
+	require.Equal(t, int32(0), atomic.LoadInt32(&engine.stops), "expected the query engine to keep running while a request is in flight")
+
+	close(release)
+	<-done
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&engine.stops) == 1
+	}, 3*time.Second, 10*time.Millisecond, "expected the query engine to be stopped after being idle")
+}
+
+func forceSleep(h *Handler) {
+	h.sleepMu.Lock()
+	h.lastActive = time.Now().Add(-time.Hour)
+	h.sleepMu.Unlock()
+	h.sleep()
+}
+
+func TestSleepModeSlowStop(t *testing.T) {
+	up := int32(1)
+	engine := &fakeEngine{release: make(chan struct{})}
+	handler, e, url := newTestAPI(t, newUpDB(t, &up), Options{
+		EnableSleepMode:   true,
+		Production:        true,
+		SleepAfterSeconds: 60,
+		Engine:            engine,
+	})
+
+	e.POST("/").WithHeader("Content-Type", "application/json").WithBytes([]byte(`{"query":"{}"}`)).
+		Expect().Status(http.StatusOK)
+	go forceSleep(handler)
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&engine.stops) == 1 }, time.Second, time.Millisecond)
+
+	// the health endpoint and new requests don't wait for the engine to stop
+	e.GET("/health").Expect().Status(http.StatusOK).Body().Equal("OK (sleeping)")
+	query := make(chan int)
+	go func() {
+		resp, err := http.Post(url, "application/json", strings.NewReader(`{"query":"{}"}`))
+		if err != nil {
+			query <- 0
+			return
+		}
+		resp.Body.Close()
+		query <- resp.StatusCode
+	}()
+	// the request waits for the engine to be stopped before starting it
+	require.Eventually(t, func() bool {
+		handler.sleepMu.Lock()
+		defer handler.sleepMu.Unlock()
+		return handler.waking != nil
+	}, time.Second, time.Millisecond)
+	require.Equal(t, int32(0), atomic.LoadInt32(&engine.starts))
+	close(engine.release)
+	require.Equal(t, http.StatusOK, <-query)
+	require.Equal(t, int32(1), atomic.LoadInt32(&engine.starts))
+}
+
+func TestSleepModeEngineNotReady(t *testing.T) {
+	defer func(timeout time.Duration) { engineReadyTimeout = timeout }(engineReadyTimeout)
+	engineReadyTimeout = 500 * time.Millisecond
+
+	up := int32(1)
+	engine := &fakeEngine{}
+	handler, e, url := newTestAPI(t, newUpDB(t, &up), Options{
+		EnableSleepMode:   true,
+		Production:        true,
+		SleepAfterSeconds: 60,
+		Engine:            engine,
+	})
+	query := func() *httpexpect.Response {
+		return e.POST("/").WithHeader("Content-Type", "application/json").WithBytes([]byte(`{"query":"{}"}`)).Expect()
+	}
+
+	query().Status(http.StatusOK)
+	forceSleep(handler)
+	require.Equal(t, int32(1), atomic.LoadInt32(&engine.stops))
+	atomic.StoreInt32(&up, 0)
+
+	waking := make(chan int)
+	go func() {
+		resp, err := http.Post(url+"/", "application/json", strings.NewReader(`{"query":"{}"}`))
+		if err != nil {
+			waking <- 0
+			return
+		}
+		_ = resp.Body.Close()
+		waking <- resp.StatusCode
+	}()
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&engine.starts) == 1
+	}, time.Second, 5*time.Millisecond)
+
+	// the health check doesn't wait for the engine that is being started
+	start := time.Now()
+	e.GET("/health").Expect().Status(http.StatusOK).Body().Equal("OK (sleeping)")
+	require.Less(t, time.Since(start), 250*time.Millisecond)
+
+	select {
+	case status := <-waking:
+		require.Equal(t, http.StatusServiceUnavailable, status)
+	case <-time.After(time.Second):
+		t.Fatal("wake did not give up after the readiness timeout")
+	}
+	require.Equal(t, int32(2), atomic.LoadInt32(&engine.stops), "an engine that isn't ready must be stopped")
+
+	// the next request starts the engine again
+	atomic.StoreInt32(&up, 1)
+	query().Status(http.StatusOK)
+	require.Equal(t, int32(2), atomic.LoadInt32(&engine.starts))
+	e.GET("/health").Expect().Status(http.StatusOK).Body().Equal("OK")
+}
+
+// newNamedDB serves a query engine that answers every query with name as data
+func newNamedDB(t *testing.T, name string) *httptest.Server {
+	return newFakeDB(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"data":"` + name + `"}`))
 	})
+}
+
+func TestSleepModePreviousEngine(t *testing.T) {
+	blueDB, greenDB := newNamedDB(t, "blue"), newNamedDB(t, "green")
+	blue, green := &fakeEngine{}, &fakeEngine{}
+	handler, e, _ := newTestAPI(t, blueDB, Options{
+		EnableSleepMode:          true,
+		SleepAfterSeconds:        60,
+		Engine:                   blue,
+		SchemaHash:               "bluehash",
+		EngineGracePeriodSeconds: 60,
+	})
+	query := func(path string) *httpexpect.Response {
+		return e.POST(path).WithHeader("Content-Type", "application/json").WithBytes([]byte(`{"query":"{}"}`)).Expect()
+	}
+
+	require.NoError(t, handler.SwitchEngine(context.Background(), green, "greenhash", greenDB.URL+"/", greenDB.URL+"/sdl"))
+	query("/4.16.2/bluehash/graphql").Status(http.StatusOK).Body().Equal(`{"data":"blue"}`)
+
+	// both engines sleep, the clients of the previous schema are served by the current engine afterwards
+	forceSleep(handler)
+	require.Equal(t, int32(1), atomic.LoadInt32(&blue.stops))
+	require.Equal(t, int32(1), atomic.LoadInt32(&green.stops))
+
+	query("/4.16.2/bluehash/graphql").Status(http.StatusOK).Body().Equal(`{"data":"green"}`)
+	require.Equal(t, int32(0), atomic.LoadInt32(&blue.starts))
+	require.Equal(t, int32(1), atomic.LoadInt32(&green.starts))
+}
+
+type fakeMigrator struct {
+	err error
+}
+
+func (f *fakeMigrator) Migrate(ctx context.Context, onLog func(migrate.LogLine)) (*migrate.Status, error) {
+	// like migrate.Runner, a running migration is reported before the migration engine starts
+	if errors.Is(f.err, migrate.ErrInProgress) {
+		return nil, f.err
+	}
+	if onLog != nil {
+		onLog(migrate.LogLine{Level: "INFO", Message: "applying"})
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &migrate.Status{State: "succeeded", Mode: "push"}, nil
+}
+
+func (f *fakeMigrator) DryRun(ctx context.Context, onLog func(migrate.LogLine)) (*migrate.DiffReport, error) {
+	return &migrate.DiffReport{Empty: true}, nil
+}
+
+func (f *fakeMigrator) Status() *migrate.Status {
+	return &migrate.Status{State: "idle"}
+}
+
+func TestAdmin(t *testing.T) {
+	migrator := &fakeMigrator{}
+	_, e, _ := newTestAPI(t, nil, Options{
+		ApiKey:      "key",
+		AdminApiKey: "admin",
+		Migrator:    migrator,
+	})
+
+	e.POST("/admin/migrate").WithHeader("Authorization", "Bearer key").Expect().Status(http.StatusUnauthorized)
+	e.GET("/admin/migrate/status").WithHeader("Authorization", "Bearer admin").
+		Expect().Status(http.StatusOK).JSON().Object().ValueEqual("state", "idle")
+	e.POST("/admin/migrate").WithHeader("Authorization", "Bearer admin").
+		Expect().Status(http.StatusOK).JSON().Object().ValueEqual("state", "succeeded")
+	e.POST("/admin/migrate/dry-run").WithHeader("Authorization", "Bearer admin").
+		Expect().Status(http.StatusOK).JSON().Object().ValueEqual("empty", true)
+
+	body := e.POST("/admin/migrate").WithHeader("Authorization", "Bearer admin").WithHeader("Accept", "application/x-ndjson").
+		Expect().Status(http.StatusOK).Body().Raw()
+	lines := strings.Split(strings.TrimSpace(body), "\n")
+	require.Len(t, lines, 2)
+	require.Contains(t, lines[0], `"message":"applying"`)
+	require.Contains(t, lines[1], `"state":"succeeded"`)
+
+	migrator.err = migrate.ErrInProgress
+	e.POST("/admin/migrate").WithHeader("Authorization", "Bearer admin").Expect().Status(http.StatusConflict)
+	e.POST("/admin/migrate").WithHeader("Authorization", "Bearer admin").WithHeader("Accept", "application/x-ndjson").
+		Expect().Status(http.StatusConflict).Body().NotContains(`"result"`)
+
+	// a failed migration without a result has no result field
+	migrator.err = errors.New("database unreachable")
+	e.POST("/admin/migrate").WithHeader("Authorization", "Bearer admin").
+		Expect().Status(http.StatusInternalServerError).Body().NotContains(`"result"`)
+
+	// without an admin API key the endpoints don't exist
+	_, e, _ = newTestAPI(t, nil, Options{ApiKey: "key"})
+	e.POST("/admin/migrate").WithHeader("Authorization", "Bearer ").Expect().Status(http.StatusNotFound)
+}
+
+func TestSwitchEngine(t *testing.T) {
+	var sdlRequests int32
+	namedDB := func(name string) *httptest.Server {
+		return newFakeDB(t, func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/sdl":
+				atomic.AddInt32(&sdlRequests, 1)
+				_, _ = w.Write([]byte("type Query { " + name + ": String }"))
+			case "/transaction/start":
+				_, _ = w.Write([]byte(`{"id":"` + name + `"}`))
+			default:
+				_, _ = w.Write([]byte(`{"data":"` + name + `"}`))
+			}
+		})
+	}
+	blueDB, greenDB := namedDB("blue"), namedDB("green")
+	blue, green := &fakeEngine{}, &fakeEngine{}
+	handler, e, _ := newTestAPI(t, blueDB, Options{Engine: blue})
+	query := func() *httpexpect.Response {
+		return e.POST("/").WithHeader("Content-Type", "application/json").WithBytes([]byte(`{"query":"{}"}`)).Expect()
+	}
+	introspect := func() *httpexpect.Response {
+		return e.POST("/").WithHeader("Content-Type", "application/json").WithBytes([]byte(`{"query":"query IntrospectionQuery {}"}`)).Expect()
+	}
+
+	query().Status(http.StatusOK).Body().Equal(`{"data":"blue"}`)
+	introspect().Status(http.StatusOK).Body().Contains("blue")
+	introspect().Status(http.StatusOK)
+	require.Equal(t, int32(1), atomic.LoadInt32(&sdlRequests), "introspection must be cached")
+
+	// an open transaction keeps the blue engine running until it is committed
+	e.POST("/4.16.2/hash/transaction/start").WithHeader("Content-Type", "application/json").WithBytes([]byte(`{"timeout":5000}`)).
+		Expect().Status(http.StatusOK).Body().Equal(`{"id":"blue"}`)
+
+	switched := make(chan error)
+	go func() {
+		switched <- handler.SwitchEngine(context.Background(), green, "green", greenDB.URL+"/", greenDB.URL+"/sdl")
+	}()
+	require.Eventually(t, func() bool {
+		return handler.current().url == greenDB.URL+"/"
+	}, time.Second, 10*time.Millisecond)
+
+	query().Status(http.StatusOK).Body().Equal(`{"data":"green"}`)
+	introspect().Status(http.StatusOK).Body().Contains("green").NotContains("blue")
+	require.Equal(t, int32(0), atomic.LoadInt32(&blue.stops))
+
+	e.POST("/4.16.2/hash/transaction/blue/commit").WithHeader("Content-Type", "application/json").WithBytes([]byte(`{}`)).
+		Expect().Status(http.StatusOK).Body().Equal(`{"data":"blue"}`)
+	select {
+	case err := <-switched:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("switch did not finish after the transaction was committed")
+	}
+	require.Equal(t, int32(1), atomic.LoadInt32(&blue.stops))
+	require.Equal(t, int32(0), atomic.LoadInt32(&green.stops))
+}
+
+func TestSwitchEngineGracePeriod(t *testing.T) {
+	blueDB, greenDB := newNamedDB(t, "blue"), newNamedDB(t, "green")
+	blue, green := &fakeEngine{}, &fakeEngine{}
+	handler, e, _ := newTestAPI(t, blueDB, Options{
+		Engine:                   blue,
+		SchemaHash:               "bluehash",
+		EngineGracePeriodSeconds: 1,
+	})
+	query := func(path string) *httpexpect.Response {
+		return e.POST(path).WithHeader("Content-Type", "application/json").WithBytes([]byte(`{"query":"{}"}`)).Expect()
+	}
+
+	require.NoError(t, handler.SwitchEngine(context.Background(), green, "greenhash", greenDB.URL+"/", greenDB.URL+"/sdl"))
+
+	// clients of the previous schema are served by the previous engine during the grace period
+	query("/4.16.2/bluehash/graphql").Status(http.StatusOK).Body().Equal(`{"data":"blue"}`)
+	query("/4.16.2/greenhash/graphql").Status(http.StatusOK).Body().Equal(`{"data":"green"}`)
+	query("/").Status(http.StatusOK).Body().Equal(`{"data":"green"}`)
+
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&blue.stops) == 1
+	}, 3*time.Second, 50*time.Millisecond, "idle previous engine must be retired")
+	query("/4.16.2/bluehash/graphql").Status(http.StatusOK).Body().Equal(`{"data":"green"}`)
+	require.Equal(t, int32(0), atomic.LoadInt32(&green.stops))
 
-	e.GET(fakeAPI.URL).Expect().Status(http.StatusOK).Body().Contains("GraphQL").Contains(fakeAPI.URL)
-	e.GET(fakeAPI.URL + "/health").Expect().Status(http.StatusOK).Body().Equal("OK")
+	// RetireEngine of an already retired engine does nothing
+	handler.RetireEngine(context.Background(), blue)
+	require.Equal(t, int32(1), atomic.LoadInt32(&blue.stops))
 }
@@ -0,0 +1,239 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wundergraph/graphql-go-tools/pkg/astparser"
+	"github.com/wundergraph/graphql-go-tools/pkg/asttransform"
+	"github.com/wundergraph/graphql-go-tools/pkg/introspection"
+)
+
+// backend is a query engine and the URLs it serves on.
+// Requests keep using the backend they started with when the handler switches engines.
+type backend struct {
+	// inFlight counts the requests proxied to this backend,
+	// it is first to be 64-bit aligned for atomic access
+	inFlight int64
+	// lastUsed is the time in unix nanoseconds a request was last sent to this backend
+	lastUsed int64
+
+	engine     Engine
+	schemaHash string
+	url        string
+	sdlURL     string
+
+	introspectionMu sync.Mutex
+	introspection   []byte
+}
+
+func newBackend(engine Engine, schemaHash, url, sdlURL string) *backend {
+	return &backend{
+		engine:     engine,
+		schemaHash: schemaHash,
+		url:        url,
+		sdlURL:     sdlURL,
+	}
+}
+
+// introspect returns the introspection result generated from the SDL of the engine,
+// it is generated once per backend
+func (b *backend) introspect() ([]byte, error) {
+	b.introspectionMu.Lock()
+	defer b.introspectionMu.Unlock()
+	if b.introspection != nil {
+		return b.introspection, nil
+	}
+	gen := introspection.NewGenerator()
+	// get the schema from the query engine on /sdl endpoint
+	resp, err := http.Get(b.sdlURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	schemaSDL, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	// generate the introspection result from the schema
+	doc, report := astparser.ParseGraphqlDocumentBytes(schemaSDL)
+	err = asttransform.MergeDefinitionWithBaseSchema(&doc)
+	if err != nil {
+		return nil, err
+	}
+	var response IntrospectionResponse
+	gen.Generate(&doc, &report, &response.Data)
+	b.introspection, err = json.Marshal(response)
+	if err != nil {
+		return nil, err
+	}
+	return b.introspection, nil
+}
+
+// current returns the backend new requests are sent to
+func (h *Handler) current() *backend {
+	h.backendMu.RLock()
+	defer h.backendMu.RUnlock()
+	return h.backend
+}
+
+// acquire returns the backend for r and counts r as in flight on it until release is called.
+// Requests of open transactions go to the backend the transaction was started on,
+// requests with the schema hash of a previous engine in their path go to that engine.
+func (h *Handler) acquire(r *http.Request) *backend {
+	h.backendMu.RLock()
+	defer h.backendMu.RUnlock()
+	b := h.transactions.backend(transactionID(r))
+	if b == nil {
+		b = h.backend
+		if hash := schemaHash(r.URL.Path); hash != "" && hash != b.schemaHash {
+			for _, previous := range h.previous {
+				if previous.schemaHash == hash {
+					b = previous
+					break
+				}
+			}
+		}
+	}
+	atomic.AddInt64(&b.inFlight, 1)
+	atomic.StoreInt64(&b.lastUsed, time.Now().UnixNano())
+	return b
+}
+
+func (h *Handler) release(b *backend) {
+	atomic.AddInt64(&b.inFlight, -1)
+}
+
+// schemaHash returns the schema hash of a Prisma client request path,
+// e.g. /4.16.2/<hash>/graphql => <hash>
+func schemaHash(path string) string {
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(parts) < 3 {
+		return ""
+	}
+	return parts[1]
+}
+
+// SwitchEngine waits until the query engine serving on url is ready and sends new requests to it.
+// schemaHash is the hash Prisma clients of the engine's schema send in the request path.
+//
+// Without a grace period, the previous engine is stopped once its in-flight requests
+// and open transactions are finished, or when ctx is done.
+// With a grace period, requests with the schema hash of the previous engine are still sent to it,
+// and it is stopped in the background once it wasn't used for the grace period.
+func (h *Handler) SwitchEngine(ctx context.Context, engine Engine, schemaHash, url, sdlURL string) error {
+	err := h.waitForEngine(ctx, url)
+	if err != nil {
+		return fmt.Errorf("wait for query engine: %w", err)
+	}
+	next := newBackend(engine, schemaHash, url, sdlURL)
+
+	h.sleepMu.Lock()
+	wasAsleep := h.asleep
+	h.backendMu.Lock()
+	previous := h.backend
+	h.backend = next
+	// an engine stopped by sleep mode can't serve old clients
+	keep := h.engineGracePeriod > 0 && !wasAsleep && previous.schemaHash != schemaHash
+	if keep {
+		h.previous = append(h.previous, previous)
+	}
+	h.backendMu.Unlock()
+	// the new engine is running, so the handler is awake even if the previous engine was asleep
+	h.asleep = false
+	h.lastActive = time.Now()
+	if h.enableSleepMode && h.inFlight == 0 && h.idleTimer == nil {
+		h.idleTimer = time.AfterFunc(h.sleepTimeout(), h.sleep)
+	}
+	h.sleepMu.Unlock()
+	log.Printf("Switched to query engine on %s", url)
+
+	if keep {
+		atomic.StoreInt64(&previous.lastUsed, time.Now().UnixNano())
+		go h.retireWhenIdle(previous)
+		return nil
+	}
+	h.retire(ctx, previous)
+	return nil
+}
+
+// RetireEngine stops sending requests to a previous engine kept for its grace period,
+// and stops it once its in-flight requests and open transactions are finished or ctx is done
+func (h *Handler) RetireEngine(ctx context.Context, engine Engine) {
+	b := h.removePrevious(func(b *backend) bool { return b.engine == engine })
+	if b == nil {
+		// already retired
+		return
+	}
+	h.retire(ctx, b)
+}
+
+// retireWhenIdle retires b once it had no requests and no open transactions for the grace period
+func (h *Handler) retireWhenIdle(b *backend) {
+	ticker := time.NewTicker(h.engineGracePeriod / 10)
+	defer ticker.Stop()
+	for range ticker.C {
+		retired := h.removePrevious(func(previous *backend) bool {
+			return previous == b && atomic.LoadInt64(&b.inFlight) == 0 && h.transactions.countOn(b) == 0 &&
+				time.Since(time.Unix(0, atomic.LoadInt64(&b.lastUsed))) >= h.engineGracePeriod
+		})
+		if retired != nil {
+			log.Printf("Query engine on %s idle for %s, stopping it", b.url, h.engineGracePeriod)
+			b.engine.Stop()
+			return
+		}
+		if !h.isPrevious(b) {
+			// retired by RetireEngine
+			return
+		}
+	}
+}
+
+// removePrevious removes the first previous backend matching match from routing and returns it
+func (h *Handler) removePrevious(match func(*backend) bool) *backend {
+	h.backendMu.Lock()
+	defer h.backendMu.Unlock()
+	for i, b := range h.previous {
+		if match(b) {
+			h.previous = append(h.previous[:i:i], h.previous[i+1:]...)
+			return b
+		}
+	}
+	return nil
+}
+
+func (h *Handler) isPrevious(b *backend) bool {
+	h.backendMu.RLock()
+	defer h.backendMu.RUnlock()
+	for _, previous := range h.previous {
+		if previous == b {
+			return true
+		}
+	}
+	return false
+}
+
+// retire waits until b has no requests in flight and no open transactions, or until ctx is done,
+// and stops its engine
+func (h *Handler) retire(ctx context.Context, b *backend) {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&b.inFlight) > 0 || h.transactions.countOn(b) > 0 {
+		select {
+		case <-ctx.Done():
+			log.Printf("Query engine on %s not drained in time, stopping it anyway", b.url)
+			b.engine.Stop()
+			return
+		case <-ticker.C:
+		}
+	}
+	b.engine.Stop()
+}
@@ -0,0 +1,380 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RedisClient is the subset of the go-redis client used by the Redis REST API
+type RedisClient interface {
+	Do(ctx context.Context, args ...interface{}) *redis.Cmd
+	Pipeline() redis.Pipeliner
+	TxPipeline() redis.Pipeliner
+	Subscribe(ctx context.Context, channels ...string) *redis.PubSub
+	PSubscribe(ctx context.Context, channels ...string) *redis.PubSub
+	XRead(ctx context.Context, a *redis.XReadArgs) *redis.XStreamSliceCmd
+	XRevRangeN(ctx context.Context, stream, start, stop string, count int64) *redis.XMessageSliceCmd
+	HGet(ctx context.Context, key, field string) *redis.StringCmd
+	HGetAll(ctx context.Context, key string) *redis.StringStringMapCmd
+	HSet(ctx context.Context, key string, values ...interface{}) *redis.IntCmd
+	HDel(ctx context.Context, key string, fields ...string) *redis.IntCmd
+	ScriptLoad(ctx context.Context, script string) *redis.StringCmd
+}
+
+// redisPipeliner creates pipelines, like the Redis client or a connection of its own
+type redisPipeliner interface {
+	Pipeline() redis.Pipeliner
+	TxPipeline() redis.Pipeliner
+}
+
+// serveRedis serves the Redis REST API compatible with @upstash/redis:
+//
+//	POST /redis             ["SET", "key", "value"] executes a single command
+//	GET  /redis/set/key/value                        executes a single command
+//	POST /redis/set/key     value                    executes a single command with the body as last argument
+//	POST /redis/pipeline    [["SET", "key", "value"], ["GET", "key"]] executes commands in a pipeline
+//	POST /redis/multi-exec  [["SET", "key", "value"], ["GET", "key"]] executes commands in a transaction
+//	GET  /redis/subscribe/channel                    streams the messages of a channel as server-sent events
+//	GET  /redis/psubscribe/pattern                   streams the messages of the channels matching a pattern
+//	GET  /redis/stream/key                           streams the new entries of a stream
+//	POST /redis/script/name {"keys": [], "args": []} calls a script registered with the admin API
+func (h *Handler) serveRedis(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/redis/script/") && r.Method == http.MethodPost:
+		h.redisScript(w, r)
+	case strings.HasPrefix(r.URL.Path, "/redis/subscribe/") && r.Method == http.MethodGet:
+		h.redisSubscribe(w, r, false)
+	case strings.HasPrefix(r.URL.Path, "/redis/psubscribe/") && r.Method == http.MethodGet:
+		h.redisSubscribe(w, r, true)
+	case strings.HasPrefix(r.URL.Path, "/redis/stream/") && r.Method == http.MethodGet:
+		h.redisStream(w, r)
+	case r.URL.Path == "/redis/pipeline" && r.Method == http.MethodPost:
+		h.redisPipeline(w, r, false)
+	case r.URL.Path == "/redis/multi-exec" && r.Method == http.MethodPost:
+		h.redisPipeline(w, r, true)
+	default:
+		h.redisCommand(w, r)
+	}
+}
+
+func (h *Handler) redisCommand(w http.ResponseWriter, r *http.Request) {
+	arr, err := parseRedisCommand(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	if len(arr) == 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "ERR empty command"})
+		return
+	}
+	key := requestApiKey(r)
+	command := arr
+	arr, err = h.authorizeRedis(r, arr)
+	if err != nil {
+		h.redisMetrics.reject(key, command)
+		writeJSON(w, http.StatusForbidden, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	prefix := h.redisPrefixes[key]
+
+	ctx, cancel, err := h.redisContext(r, arr)
+	if err != nil {
+		h.redisMetrics.reject(key, command)
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	defer cancel()
+	start := time.Now()
+	var cmd *redis.Cmd
+	if blockingCommand(arr) != nil {
+		err = h.runBlocking(ctx, arr, func(conn *redis.Conn) {
+			cmd = redis.NewCmd(ctx, arr...)
+			_ = conn.Process(ctx, cmd)
+		})
+	} else {
+		err = runRedis(ctx, func() {
+			cmd = h.doRedis(ctx, arr)
+		})
+	}
+	if err == nil {
+		err = cmd.Err()
+	}
+	h.redisMetrics.count(key, arr, err)
+	h.redisMetrics.observe(key, commandLabel(arr), len(arr)-1, start)
+	if err != nil && ctx.Err() != nil {
+		// timed out or the client disconnected
+		writeRedisTimeout(w, ctx)
+		return
+	}
+	if cmd == nil {
+		// the blocking command didn't get a connection
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	response := redisResponse(cmd, prefix, base64Encoding(r))
+	if _, failed := response["error"]; failed {
+		writeJSON(w, http.StatusBadRequest, response)
+		return
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// redisPipeline executes the commands of the request body in a pipeline, or in a MULTI/EXEC transaction if tx is set.
+// The response has a {"result": ...} or {"error": "..."} entry per command.
+func (h *Handler) redisPipeline(w http.ResponseWriter, r *http.Request, tx bool) {
+	var commands [][]interface{}
+	err := json.NewDecoder(r.Body).Decode(&commands)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	if len(commands) == 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "ERR empty pipeline"})
+		return
+	}
+	key := requestApiKey(r)
+	prefix := h.redisPrefixes[key]
+	rejectAll := func() {
+		for _, command := range commands {
+			h.redisMetrics.reject(key, command)
+		}
+	}
+	for i, command := range commands {
+		if len(command) == 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "ERR empty command in pipeline"})
+			return
+		}
+		// nothing is executed if a single command is not allowed
+		commands[i], err = h.authorizeRedis(r, command)
+		if err != nil {
+			commands[i] = command
+			rejectAll()
+			writeJSON(w, http.StatusForbidden, map[string]interface{}{"error": err.Error()})
+			return
+		}
+	}
+
+	ctx, cancel, err := h.redisContext(r, commands...)
+	if err != nil {
+		rejectAll()
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	defer cancel()
+	cmds := make([]*redis.Cmd, len(commands))
+	var execErr error
+	exec := func(client redisPipeliner) {
+		pipe := client.Pipeline()
+		if tx {
+			pipe = client.TxPipeline()
+		}
+		for i, command := range commands {
+			cmds[i] = pipe.Do(ctx, command...)
+		}
+		// errors of single commands are reported in their entry
+		_, execErr = pipe.Exec(ctx)
+	}
+	start := time.Now()
+	if blocking := blockingCommand(commands...); blocking != nil {
+		err = h.runBlocking(ctx, blocking, func(conn *redis.Conn) {
+			exec(conn)
+		})
+	} else {
+		err = runRedis(ctx, func() {
+			exec(h.redis)
+		})
+	}
+	label, args := "PIPELINE", 0
+	if tx {
+		label = "MULTI-EXEC"
+	}
+	for i, command := range commands {
+		if err != nil {
+			h.redisMetrics.count(key, command, err)
+		} else {
+			h.redisMetrics.count(key, command, cmds[i].Err())
+		}
+		args += len(command)
+	}
+	h.redisMetrics.observe(key, label, args, start)
+	if err != nil && ctx.Err() == nil {
+		// the blocking command didn't get a connection
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	if err != nil || execErr != nil && ctx.Err() != nil {
+		writeRedisTimeout(w, ctx)
+		return
+	}
+	err = execErr
+	if tx && err != nil && isTxAborted(err) {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	responses := make([]map[string]interface{}, len(cmds))
+	encode := base64Encoding(r)
+	for i, cmd := range cmds {
+		responses[i] = redisResponse(cmd, prefix, encode)
+	}
+	writeJSON(w, http.StatusOK, responses)
+}
+
+// parseRedisCommand returns the command of a request like @upstash/redis sends it:
+//
+//	POST /redis            ["SET", "key", "value"]
+//	GET  /redis/set/key/value
+//	POST /redis/set/key    with the value as body
+//
+// Path segments are percent-decoded, so values may contain "/" as %2F.
+// Query parameters are appended as arguments, e.g. ?EX=100 as "EX", "100", or ?NX as "NX".
+func parseRedisCommand(r *http.Request) ([]interface{}, error) {
+	var arr []interface{}
+	path := strings.TrimPrefix(r.URL.EscapedPath(), "/redis")
+	switch {
+	case r.Method == http.MethodPost && (path == "" || path == "/"):
+		err := json.NewDecoder(r.Body).Decode(&arr)
+		if err != nil {
+			return nil, err
+		}
+	case r.Method == http.MethodGet || r.Method == http.MethodPost:
+		if path == "" || path == "/" {
+			return nil, nil
+		}
+		for _, segment := range strings.Split(strings.TrimPrefix(path, "/"), "/") {
+			arg, err := url.PathUnescape(segment)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, arg)
+		}
+		if r.Method == http.MethodPost {
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				return nil, err
+			}
+			if len(body) != 0 {
+				arr = append(arr, string(body))
+			}
+		}
+	default:
+		return nil, fmt.Errorf("ERR method %s is not supported", r.Method)
+	}
+
+	// url.Values doesn't keep the order of the parameters
+	for _, param := range strings.Split(r.URL.RawQuery, "&") {
+		if param == "" {
+			continue
+		}
+		name, value, hasValue := strings.Cut(param, "=")
+		name, err := url.QueryUnescape(name)
+		if err != nil {
+			return nil, err
+		}
+		if name == "api_key" || name == "_token" {
+			// authenticates the request
+			continue
+		}
+		arr = append(arr, name)
+		if hasValue {
+			value, err = url.QueryUnescape(value)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, value)
+		}
+	}
+	return arr, nil
+}
+
+// authorizeRedis checks that the API key of r may run command,
+// and returns command with the key prefix of the API key added to its keys
+func (h *Handler) authorizeRedis(r *http.Request, command []interface{}) ([]interface{}, error) {
+	key := requestApiKey(r)
+	err := h.redisACL.check(key, command)
+	if err != nil {
+		return nil, err
+	}
+	if prefix := h.redisPrefixes[key]; prefix != "" {
+		command, err = prefixKeys(prefix, command)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// e.g. changing the script registry would run any script as a named script
+	name := strings.ToUpper(fmt.Sprint(command[0]))
+	for _, i := range redisCommands[name].keyPositions(command) {
+		if i >= len(command) {
+			break
+		}
+		if k := fmt.Sprint(command[i]); h.redisReserved[k] {
+			return nil, fmt.Errorf("ERR key %s is reserved by the proxy", k)
+		}
+	}
+	return command, nil
+}
+
+// redisResponse returns {"result": ...} for a successful command and {"error": "..."} for a failed one,
+// a missing value is a null result.
+// With a prefix, it is removed from the keys of the result.
+// With encode, the strings of the result are base64 encoded.
+func redisResponse(cmd *redis.Cmd, prefix string, encode bool) map[string]interface{} {
+	result, err := cmd.Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return map[string]interface{}{
+			"error": err.Error(),
+		}
+	}
+	if prefix != "" {
+		result = stripKeys(prefix, cmd.Name(), result)
+	}
+	if encode {
+		result = encodeRedisResult(result)
+	}
+	return map[string]interface{}{
+		"result": result,
+	}
+}
+
+// base64Encoding reports whether the client asked for base64 encoded results,
+// @upstash/redis does by default so binary values survive JSON
+func base64Encoding(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upstash-Encoding"), "base64")
+}
+
+// encodeRedisResult base64 encodes the strings of result, also in nested arrays.
+// "OK" is left as is, like Upstash does, numbers and nil are not encoded.
+func encodeRedisResult(result interface{}) interface{} {
+	switch result := result.(type) {
+	case string:
+		if result == "OK" {
+			return result
+		}
+		return base64.StdEncoding.EncodeToString([]byte(result))
+	case []interface{}:
+		encoded := make([]interface{}, len(result))
+		for i, item := range result {
+			encoded[i] = encodeRedisResult(item)
+		}
+		return encoded
+	default:
+		return result
+	}
+}
+
+// isTxAborted reports whether a transaction was discarded as a whole,
+// e.g. because a command could not be queued
+func isTxAborted(err error) bool {
+	return strings.HasPrefix(err.Error(), "EXECABORT")
+}
@@ -0,0 +1,175 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+)
+
+// scopes of Redis commands, an API key may only run the commands of its scopes
+const (
+	RedisScopeRead  = "read"
+	RedisScopeWrite = "write"
+	RedisScopeAdmin = "admin"
+)
+
+// RedisScopes are all scopes of Redis commands
+var RedisScopes = []string{RedisScopeRead, RedisScopeWrite, RedisScopeAdmin}
+
+// redisCommand describes a Redis command for access control and key namespacing
+type redisCommand struct {
+	scope string
+	// positions of the key arguments, a negative lastKey counts from the end
+	firstKey, lastKey, keyStep int
+	// keys returns the positions of the key arguments of commands with a variable layout
+	keys func(args []interface{}) []int
+	// global commands use the keys of all tenants and can't be namespaced
+	global bool
+}
+
+// redisCommands are the commands of the REST API by name,
+// commands that are not listed belong to the admin scope
+var redisCommands = map[string]redisCommand{}
+
+func init() {
+	for scope, names := range map[string][]string{
+		RedisScopeRead: {
+			"BITCOUNT", "BITPOS", "DBSIZE", "ECHO", "EXISTS", "GEODIST", "GEOHASH", "GEOPOS", "GEOSEARCH",
+			"GET", "GETBIT", "GETRANGE", "HEXISTS", "HGET", "HGETALL", "HKEYS", "HLEN", "HMGET", "HRANDFIELD",
+			"HSCAN", "HSTRLEN", "HVALS", "LINDEX", "LLEN", "LPOS", "LRANGE", "MGET", "PFCOUNT", "PING", "PTTL",
+			"RANDOMKEY", "SCAN", "SCARD", "SDIFF", "SINTER", "SISMEMBER", "SMEMBERS", "SMISMEMBER", "SRANDMEMBER",
+			"SSCAN", "STRLEN", "SUNION", "TTL", "TYPE", "XLEN", "XPENDING", "XRANGE", "XREAD", "XREVRANGE",
+			"ZCARD", "ZCOUNT", "ZLEXCOUNT", "ZMSCORE", "ZRANDMEMBER", "ZRANGE", "ZRANGEBYLEX", "ZRANGEBYSCORE",
+			"ZRANK", "ZREVRANGE", "ZREVRANGEBYLEX", "ZREVRANGEBYSCORE", "ZREVRANK", "ZSCAN", "ZSCORE",
+		},
+		RedisScopeWrite: {
+			"APPEND", "BLPOP", "BRPOP", "BZPOPMAX", "BZPOPMIN", "COPY", "DECR", "DECRBY", "DEL",
+			"EXPIRE", "EXPIREAT", "GEOADD", "GETDEL", "GETEX", "GETSET", "HDEL", "HINCRBY", "HINCRBYFLOAT", "HMSET",
+			"HSET", "HSETNX", "INCR", "INCRBY", "INCRBYFLOAT", "LINSERT", "LMOVE", "LPOP", "LPUSH", "LPUSHX", "LREM",
+			"LSET", "LTRIM", "MSET", "MSETNX", "PERSIST", "PEXPIRE", "PEXPIREAT", "PFADD", "PFMERGE", "PSETEX",
+			"PUBLISH", "RENAME", "RENAMENX", "RPOP", "RPOPLPUSH", "RPUSH", "RPUSHX", "SADD", "SDIFFSTORE", "SET",
+			"SETBIT", "SETEX", "SETNX", "SETRANGE", "SINTERSTORE", "SMOVE", "SPOP", "SREM", "SUNIONSTORE", "TOUCH",
+			"UNLINK", "XACK", "XADD", "XCLAIM", "XDEL", "XGROUP", "XTRIM", "ZADD", "ZINCRBY", "ZPOPMAX", "ZPOPMIN",
+			"ZREM", "ZREMRANGEBYLEX", "ZREMRANGEBYRANK", "ZREMRANGEBYSCORE", "ZUNIONSTORE", "ZINTERSTORE",
+		},
+		// scripts can call any command, see scriptCommands
+		RedisScopeAdmin: {"EVAL", "EVALSHA", "SCRIPT"},
+	} {
+		for _, name := range names {
+			redisCommands[name] = redisCommand{scope: scope, firstKey: 1, lastKey: 1, keyStep: 1}
+		}
+	}
+	setKeyPositions()
+}
+
+// scriptCommands run Lua scripts, which can call any command with redis.call,
+// including admin commands and the commands of REDIS_DENIED_COMMANDS
+var scriptCommands = map[string]bool{"EVAL": true, "EVALSHA": true, "SCRIPT": true}
+
+// subscribeCommands are only run by redisSubscribe on a connection of its own,
+// the command endpoints would switch a pooled connection into subscriber mode
+var subscribeCommands = map[string]bool{
+	"SUBSCRIBE": true, "PSUBSCRIBE": true, "SSUBSCRIBE": true, "UNSUBSCRIBE": true, "PUNSUBSCRIBE": true, "SUNSUBSCRIBE": true,
+}
+
+// redisACL decides which commands an API key may run
+type redisACL struct {
+	// scopes of the API keys that may use the REST API
+	scopes map[string]map[string]bool
+	// allowed is empty if all commands are allowed
+	allowed map[string]bool
+	denied  map[string]bool
+}
+
+func newRedisACL(keys map[string][]string, allowed, denied []string) *redisACL {
+	acl := &redisACL{
+		scopes:  map[string]map[string]bool{},
+		allowed: commandSet(allowed),
+		denied:  commandSet(denied),
+	}
+	for key, scopes := range keys {
+		acl.scopes[key] = map[string]bool{}
+		for _, scope := range scopes {
+			acl.scopes[key][scope] = true
+		}
+	}
+	return acl
+}
+
+func commandSet(names []string) map[string]bool {
+	set := map[string]bool{}
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name != "" {
+			set[strings.ToUpper(name)] = true
+		}
+	}
+	return set
+}
+
+// isKey reports whether key may use the REST API
+func (a *redisACL) isKey(key string) bool {
+	_, ok := a.scopes[key]
+	return ok
+}
+
+// check returns an error describing why key may not run command, or nil
+func (a *redisACL) check(key string, command []interface{}) error {
+	if len(command) == 0 {
+		return fmt.Errorf("ERR empty command")
+	}
+	name := strings.ToUpper(fmt.Sprint(command[0]))
+	if subscribeCommands[name] {
+		return fmt.Errorf("ERR command %s is only supported by the subscribe endpoints", name)
+	}
+	err := a.checkLists(name)
+	if err != nil {
+		return err
+	}
+	scope := redisScope(name)
+	if !a.scopes[key][scope] {
+		return fmt.Errorf("ERR command %s requires the %s scope, which the API key doesn't have", name, scope)
+	}
+	return nil
+}
+
+// checkSubscribe returns an error describing why key may not subscribe with command name, SUBSCRIBE or PSUBSCRIBE, or nil
+func (a *redisACL) checkSubscribe(key, name string) error {
+	err := a.checkLists(name)
+	if err != nil {
+		return err
+	}
+	if !a.scopes[key][RedisScopeRead] {
+		return fmt.Errorf("ERR command %s requires the %s scope, which the API key doesn't have", name, RedisScopeRead)
+	}
+	return nil
+}
+
+// checkLists checks the command name against REDIS_DENIED_COMMANDS and REDIS_ALLOWED_COMMANDS
+func (a *redisACL) checkLists(name string) error {
+	if a.denied[name] {
+		return fmt.Errorf("ERR command %s is denied by REDIS_DENIED_COMMANDS", name)
+	}
+	if scriptCommands[name] && (len(a.allowed) != 0 || len(a.denied) != 0) && !a.allowed[name] {
+		return fmt.Errorf("ERR command %s can call any command, it must be in REDIS_ALLOWED_COMMANDS while commands are restricted", name)
+	}
+	if len(a.allowed) != 0 && !a.allowed[name] {
+		return fmt.Errorf("ERR command %s is not in REDIS_ALLOWED_COMMANDS", name)
+	}
+	return nil
+}
+
+// checkScript returns an error describing why key may not call the named scripts, or nil.
+// The named scripts are registered with the admin API, so calling them only requires the write scope.
+func (a *redisACL) checkScript(key string) error {
+	if !a.scopes[key][RedisScopeWrite] {
+		return fmt.Errorf("ERR scripts require the %s scope, which the API key doesn't have", RedisScopeWrite)
+	}
+	return nil
+}
+
+// redisScope returns the scope of the command name
+func redisScope(name string) string {
+	if c, ok := redisCommands[name]; ok {
+		return c.scope
+	}
+	return RedisScopeAdmin
+}
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"wunderbase/pkg/metrics"
+)
+
+// redisMetrics are the metrics of the Redis REST API
+type redisMetrics struct {
+	apiKey        string
+	commands      *metrics.Counter
+	errors        *metrics.Counter
+	rejected      *metrics.Counter
+	duration      *metrics.Histogram
+	slow          *metrics.Counter
+	slowThreshold time.Duration
+}
+
+func newRedisMetrics(registry *metrics.Registry, apiKey string, slowThreshold time.Duration) *redisMetrics {
+	return &redisMetrics{
+		apiKey: apiKey,
+		commands: registry.Counter("wunderbase_redis_commands_total",
+			"Number of commands executed by the Redis REST API.", "command", "api_key"),
+		errors: registry.Counter("wunderbase_redis_command_errors_total",
+			"Number of commands of the Redis REST API that failed or timed out.", "command", "api_key"),
+		rejected: registry.Counter("wunderbase_redis_commands_rejected_total",
+			"Number of commands the Redis REST API didn't execute because the API key may not run them.", "command", "api_key"),
+		duration: registry.Histogram("wunderbase_redis_command_duration_seconds",
+			"Time of the commands of the Redis REST API, pipelines and transactions are timed as PIPELINE and MULTI-EXEC.",
+			[]float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 5}, "command"),
+		slow: registry.Counter("wunderbase_redis_slow_commands_total",
+			"Number of commands of the Redis REST API that took longer than REDIS_SLOW_COMMAND_THRESHOLD_MS.", "command"),
+		slowThreshold: slowThreshold,
+	}
+}
+
+// commandLabel returns the name of command if it is known,
+// other names are "OTHER" so clients can't create any number of metrics
+func commandLabel(command []interface{}) string {
+	if len(command) == 0 {
+		return "OTHER"
+	}
+	name := strings.ToUpper(fmt.Sprint(command[0]))
+	if _, ok := redisCommands[name]; ok {
+		return name
+	}
+	if _, ok := blockingCommands[name]; ok || name == "SCRIPT" || subscribeCommands[name] {
+		return name
+	}
+	return "OTHER"
+}
+
+// keyLabel identifies an API key without exposing it,
+// API_KEY is "api_key" and the other keys are the start of their SHA256
+func (m *redisMetrics) keyLabel(key string) string {
+	if key == m.apiKey {
+		return "api_key"
+	}
+	sum := sha256.Sum256([]byte(key))
+	return "sha256:" + hex.EncodeToString(sum[:4])
+}
+
+// count counts a command that was executed, a missing value is no error
+func (m *redisMetrics) count(key string, command []interface{}, err error) {
+	label, keyLabel := commandLabel(command), m.keyLabel(key)
+	logMetric(m.commands.Inc(label, keyLabel))
+	if err != nil && !errors.Is(err, redis.Nil) {
+		logMetric(m.errors.Inc(label, keyLabel))
+	}
+}
+
+func (m *redisMetrics) reject(key string, command []interface{}) {
+	logMetric(m.rejected.Inc(commandLabel(command), m.keyLabel(key)))
+}
+
+// observe records the time of a command, pipeline or transaction, which is logged if it was slow.
+// Only the name and the number of arguments are logged, the arguments may be sensitive.
+func (m *redisMetrics) observe(key, label string, args int, start time.Time) {
+	took := time.Since(start)
+	logMetric(m.duration.Observe(took.Seconds(), label))
+	if m.slowThreshold > 0 && took >= m.slowThreshold {
+		logMetric(m.slow.Inc(label))
+		log.Printf("Slow Redis command %s with %d arguments took %s, API key %s", label, args, took, m.keyLabel(key))
+	}
+}
@@ -0,0 +1,197 @@
+package api
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// setKeyPositions adds the key positions to redisCommands, the commands have one key at position 1 by default
+func setKeyPositions() {
+	for _, name := range []string{
+		"DEL", "EXISTS", "MGET", "PFCOUNT", "PFMERGE", "SDIFF", "SDIFFSTORE", "SINTER", "SINTERSTORE",
+		"SUNION", "SUNIONSTORE", "TOUCH", "UNLINK",
+	} {
+		setKeys(name, 1, -1, 1)
+	}
+	for _, name := range []string{"BLPOP", "BRPOP", "BZPOPMAX", "BZPOPMIN"} {
+		// the last argument is the timeout
+		setKeys(name, 1, -2, 1)
+	}
+	for _, name := range []string{"COPY", "LMOVE", "RENAME", "RENAMENX", "RPOPLPUSH", "SMOVE"} {
+		setKeys(name, 1, 2, 1)
+	}
+	for _, name := range []string{"MSET", "MSETNX"} {
+		setKeys(name, 1, -1, 2)
+	}
+	for _, name := range []string{"PING", "ECHO", "SCAN", "SCRIPT"} {
+		setKeys(name, 0, 0, 0)
+	}
+	for _, name := range []string{"DBSIZE", "RANDOMKEY"} {
+		c := redisCommands[name]
+		c.global = true
+		redisCommands[name] = c
+	}
+	// ZUNIONSTORE destination numkeys key [key ...] [WEIGHTS ...]
+	setVariableKeys("ZUNIONSTORE", numKeys(2, 1))
+	setVariableKeys("ZINTERSTORE", numKeys(2, 1))
+	// XREAD [COUNT count] [BLOCK ms] STREAMS key [key ...] id [id ...]
+	setVariableKeys("XREAD", func(args []interface{}) []int {
+		for i := 1; i < len(args); i++ {
+			if strings.EqualFold(fmt.Sprint(args[i]), "STREAMS") {
+				n := (len(args) - i - 1) / 2
+				return positions(i+1, i+n)
+			}
+		}
+		return nil
+	})
+	// XGROUP CREATE key group id
+	setVariableKeys("XGROUP", func(args []interface{}) []int {
+		if len(args) < 3 || strings.EqualFold(fmt.Sprint(args[1]), "HELP") {
+			return nil
+		}
+		return []int{2}
+	})
+	// KEYS pattern, the pattern is prefixed instead like the patterns of PSUBSCRIBE, see subscribeChannel
+	redisCommands["KEYS"] = redisCommand{scope: RedisScopeAdmin}
+}
+
+func setKeys(name string, first, last, step int) {
+	c := redisCommands[name]
+	c.firstKey, c.lastKey, c.keyStep = first, last, step
+	redisCommands[name] = c
+}
+
+func setVariableKeys(name string, keys func(args []interface{}) []int) {
+	c := redisCommands[name]
+	c.keys = keys
+	redisCommands[name] = c
+}
+
+// numKeys returns the key positions of commands with the number of keys at position n,
+// followed by the keys, plus the fixed key positions of before
+func numKeys(n int, before ...int) func(args []interface{}) []int {
+	return func(args []interface{}) []int {
+		keys := append([]int{}, before...)
+		if len(args) <= n {
+			return keys
+		}
+		count, err := strconv.Atoi(fmt.Sprint(args[n]))
+		if err != nil || count <= 0 {
+			// Redis reports the invalid number of keys
+			return keys
+		}
+		return append(keys, positions(n+1, n+count)...)
+	}
+}
+
+// positions returns first to last
+func positions(first, last int) []int {
+	var keys []int
+	for i := first; i <= last; i++ {
+		keys = append(keys, i)
+	}
+	return keys
+}
+
+// keyPositions returns the positions of the key arguments of args
+func (c redisCommand) keyPositions(args []interface{}) []int {
+	if c.keys != nil {
+		return c.keys(args)
+	}
+	if c.keyStep == 0 {
+		return nil
+	}
+	last := c.lastKey
+	if last < 0 {
+		last += len(args)
+	}
+	var keys []int
+	for i := c.firstKey; i <= last && i < len(args); i += c.keyStep {
+		keys = append(keys, i)
+	}
+	return keys
+}
+
+// prefixKeys returns a copy of command with prefix added to its keys,
+// so API keys with different prefixes can't use each other's keys
+func prefixKeys(prefix string, command []interface{}) ([]interface{}, error) {
+	name := strings.ToUpper(fmt.Sprint(command[0]))
+	if scriptCommands[name] {
+		// a script can access any key with redis.call, not only the keys it declares
+		return nil, fmt.Errorf("ERR command %s can't be used with a key prefix, call a named script instead", name)
+	}
+	c := redisCommands[name]
+	if c.global || (redisScope(name) == RedisScopeAdmin && name != "KEYS") {
+		return nil, fmt.Errorf("ERR command %s can't be used with a key prefix", name)
+	}
+	prefixed := append([]interface{}{}, command...)
+	for _, i := range c.keyPositions(command) {
+		if i < len(prefixed) {
+			prefixed[i] = prefix + fmt.Sprint(prefixed[i])
+		}
+	}
+	pattern := escapeGlob(prefix)
+	switch name {
+	case "KEYS":
+		for i := 1; i < len(prefixed); i++ {
+			prefixed[i] = pattern + fmt.Sprint(prefixed[i])
+		}
+	case "SCAN":
+		// SCAN cursor [MATCH pattern] [COUNT count] [TYPE type],
+		// Redis uses the last MATCH, so every one is prefixed
+		matched := false
+		for i := 2; i < len(prefixed)-1; i += 2 {
+			if strings.EqualFold(fmt.Sprint(prefixed[i]), "MATCH") {
+				prefixed[i+1] = pattern + fmt.Sprint(prefixed[i+1])
+				matched = true
+			}
+		}
+		if !matched {
+			prefixed = append(prefixed, "MATCH", pattern+"*")
+		}
+	}
+	return prefixed, nil
+}
+
+// stripKeys removes prefix from the keys returned by KEYS and SCAN
+func stripKeys(prefix, name string, result interface{}) interface{} {
+	switch strings.ToUpper(name) {
+	case "KEYS":
+		return stripPrefix(prefix, result)
+	case "SCAN":
+		// [cursor, [key ...]]
+		if page, ok := result.([]interface{}); ok && len(page) == 2 {
+			return []interface{}{page[0], stripPrefix(prefix, page[1])}
+		}
+	}
+	return result
+}
+
+func stripPrefix(prefix string, keys interface{}) interface{} {
+	list, ok := keys.([]interface{})
+	if !ok {
+		return keys
+	}
+	stripped := make([]interface{}, len(list))
+	for i, key := range list {
+		if s, ok := key.(string); ok {
+			stripped[i] = strings.TrimPrefix(s, prefix)
+		} else {
+			stripped[i] = key
+		}
+	}
+	return stripped
+}
+
+// escapeGlob escapes the special characters of a Redis glob pattern
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
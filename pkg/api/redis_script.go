@@ -0,0 +1,265 @@
+package api
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// maxCachedScripts limits the scripts that are kept to load them again after NOSCRIPT
+const maxCachedScripts = 1000
+
+// scriptCache keeps the sources of the Lua scripts sent through the proxy by their SHA1
+type scriptCache struct {
+	mu      sync.RWMutex
+	sources map[string]string
+}
+
+func newScriptCache() *scriptCache {
+	return &scriptCache{
+		sources: map[string]string{},
+	}
+}
+
+// add returns the SHA1 of source
+func (c *scriptCache) add(source string) string {
+	sum := sha1.Sum([]byte(source))
+	sha := hex.EncodeToString(sum[:])
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.sources) < maxCachedScripts {
+		c.sources[sha] = source
+	}
+	return sha
+}
+
+func (c *scriptCache) get(sha string) (string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	source, ok := c.sources[strings.ToLower(sha)]
+	return source, ok
+}
+
+func isNoScript(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT")
+}
+
+// doRedis runs a single command.
+// EVAL is sent as EVALSHA, so Redis doesn't parse the script every time, and as EVAL after NOSCRIPT,
+// which loads the script for the next time.
+// EVALSHA of a script that was sent through the proxy before is sent as EVAL after NOSCRIPT,
+// e.g. after Redis restarted or failed over.
+func (h *Handler) doRedis(ctx context.Context, command []interface{}) *redis.Cmd {
+	name := strings.ToUpper(fmt.Sprint(command[0]))
+	switch {
+	case name == "EVAL" && len(command) > 1:
+		sha := h.redisScripts.add(fmt.Sprint(command[1]))
+		cmd := h.redis.Do(ctx, append([]interface{}{"EVALSHA", sha}, command[2:]...)...)
+		if !isNoScript(cmd.Err()) {
+			return cmd
+		}
+		return h.redis.Do(ctx, command...)
+	case name == "EVALSHA" && len(command) > 1:
+		cmd := h.redis.Do(ctx, command...)
+		if source, ok := h.redisScripts.get(fmt.Sprint(command[1])); ok && isNoScript(cmd.Err()) {
+			return h.redis.Do(ctx, append([]interface{}{"EVAL", source}, command[2:]...)...)
+		}
+		return cmd
+	case name == "SCRIPT" && len(command) > 2 && strings.EqualFold(fmt.Sprint(command[1]), "LOAD"):
+		cmd := h.redis.Do(ctx, command...)
+		if cmd.Err() == nil {
+			h.redisScripts.add(fmt.Sprint(command[2]))
+		}
+		return cmd
+	}
+	return h.redis.Do(ctx, command...)
+}
+
+// RedisScript is a Lua script registered with the admin API, which clients call by its name
+type RedisScript struct {
+	Name   string `json:"name"`
+	Script string `json:"script"`
+	SHA    string `json:"sha"`
+	// number of keys and arguments of every call
+	Keys int `json:"keys"`
+	Args int `json:"args"`
+}
+
+// redisScript calls a named script with the keys and arguments of the body:
+//
+//	POST /redis/script/{name}  {"keys": ["key"], "args": ["value", 1]}
+func (h *Handler) redisScript(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/redis/script/")
+	var call struct {
+		Keys []string      `json:"keys"`
+		Args []interface{} `json:"args"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&call)
+	if err != nil && err != io.EOF {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	// keys that may not call scripts can't find out which scripts exist
+	key := requestApiKey(r)
+	err = h.redisACL.checkScript(key)
+	if err != nil {
+		h.redisMetrics.reject(key, []interface{}{"EVALSHA"})
+		writeJSON(w, http.StatusForbidden, map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	ctx, cancel, _ := h.redisContext(r)
+	defer cancel()
+	script, err := h.loadRedisScript(ctx, name)
+	if errors.Is(err, redis.Nil) {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"error": "ERR unknown script " + name})
+		return
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			writeRedisTimeout(w, ctx)
+			return
+		}
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	if len(call.Keys) != script.Keys || len(call.Args) != script.Args {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error": fmt.Sprintf("ERR script %s takes %d keys and %d args, got %d keys and %d args",
+				name, script.Keys, script.Args, len(call.Keys), len(call.Args)),
+		})
+		return
+	}
+
+	prefix := h.redisPrefixes[key]
+	command := []interface{}{"EVALSHA", script.SHA, len(call.Keys)}
+	for _, k := range call.Keys {
+		command = append(command, prefix+k)
+	}
+	command = append(command, call.Args...)
+	start := time.Now()
+	var cmd *redis.Cmd
+	err = runRedis(ctx, func() {
+		cmd = h.redis.Do(ctx, command...)
+		if isNoScript(cmd.Err()) {
+			cmd = h.redis.Do(ctx, append([]interface{}{"EVAL", script.Script}, command[2:]...)...)
+		}
+	})
+	if err == nil {
+		err = cmd.Err()
+	}
+	h.redisMetrics.count(key, command, err)
+	h.redisMetrics.observe(key, "EVALSHA", len(command)-1, start)
+	if err != nil && ctx.Err() != nil {
+		writeRedisTimeout(w, ctx)
+		return
+	}
+	response := redisResponse(cmd, "", base64Encoding(r))
+	if _, failed := response["error"]; failed {
+		writeJSON(w, http.StatusBadRequest, response)
+		return
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// loadRedisScript returns the named script, the scripts are kept in Redis so all replicas serve the same scripts
+func (h *Handler) loadRedisScript(ctx context.Context, name string) (*RedisScript, error) {
+	data, err := h.redis.HGet(ctx, h.redisScriptsKey, name).Result()
+	if err != nil {
+		return nil, err
+	}
+	script := &RedisScript{}
+	err = json.Unmarshal([]byte(data), script)
+	if err != nil {
+		return nil, err
+	}
+	// the source is sent as EVAL after NOSCRIPT, so it must be the script registered with the admin API
+	sum := sha1.Sum([]byte(script.Script))
+	if !strings.EqualFold(script.SHA, hex.EncodeToString(sum[:])) {
+		return nil, fmt.Errorf("ERR script %s doesn't match its SHA1", name)
+	}
+	return script, nil
+}
+
+// adminRedisScripts manages the named scripts:
+//
+//	GET    /admin/redis/scripts         lists the scripts
+//	PUT    /admin/redis/scripts/{name}  registers a script {"script": "...", "keys": 1, "args": 1}
+//	DELETE /admin/redis/scripts/{name}  removes a script
+func (h *Handler) adminRedisScripts(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/redis/scripts"), "/")
+	ctx := r.Context()
+	switch {
+	case name == "" && r.Method == http.MethodGet:
+		all, err := h.redis.HGetAll(ctx, h.redisScriptsKey).Result()
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, adminEvent{Error: err.Error()})
+			return
+		}
+		scripts := []*RedisScript{}
+		for _, data := range all {
+			script := &RedisScript{}
+			if json.Unmarshal([]byte(data), script) == nil {
+				scripts = append(scripts, script)
+			}
+		}
+		sort.Slice(scripts, func(i, j int) bool {
+			return scripts[i].Name < scripts[j].Name
+		})
+		writeJSON(w, http.StatusOK, scripts)
+	case name != "" && !strings.Contains(name, "/") && r.Method == http.MethodPut:
+		script := &RedisScript{}
+		err := json.NewDecoder(r.Body).Decode(script)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, adminEvent{Error: err.Error()})
+			return
+		}
+		if script.Script == "" || script.Keys < 0 || script.Args < 0 {
+			writeJSON(w, http.StatusBadRequest, adminEvent{Error: "script must not be empty and keys and args must not be negative"})
+			return
+		}
+		// loading compiles the script, so broken scripts are rejected
+		script.Name = name
+		script.SHA, err = h.redis.ScriptLoad(ctx, script.Script).Result()
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, adminEvent{Error: err.Error()})
+			return
+		}
+		data, err := json.Marshal(script)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, adminEvent{Error: err.Error()})
+			return
+		}
+		err = h.redis.HSet(ctx, h.redisScriptsKey, name, data).Err()
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, adminEvent{Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, script)
+	case name != "" && r.Method == http.MethodDelete:
+		deleted, err := h.redis.HDel(ctx, h.redisScriptsKey, name).Result()
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, adminEvent{Error: err.Error()})
+			return
+		}
+		if deleted == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
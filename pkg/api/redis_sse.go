@@ -0,0 +1,245 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// sseKeepAlive is the interval of the comments that keep idle event streams open
+var sseKeepAlive = 15 * time.Second
+
+// redisStreamBlock is how long XREAD waits for new entries before it is sent again
+var redisStreamBlock = 5 * time.Second
+
+// sseWriter writes server-sent events
+type sseWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func startSSE(w http.ResponseWriter) (*sseWriter, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, fmt.Errorf("streaming is not supported")
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// disables the response buffering of nginx
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	return &sseWriter{w: w, flusher: flusher}, nil
+}
+
+// event writes an event with data encoded as JSON, the id is omitted if empty
+func (s *sseWriter) event(id, event string, data interface{}) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if id != "" {
+		_, err = fmt.Fprintf(s.w, "id: %s\n", id)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, encoded)
+	if err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+func (s *sseWriter) keepAlive() error {
+	_, err := s.w.Write([]byte(": keep-alive\n\n"))
+	if err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+// subscribeChannel returns the channel or pattern with the key prefix, like the channels of PUBLISH
+func subscribeChannel(prefix, channel string, pattern bool) string {
+	if pattern {
+		return escapeGlob(prefix) + channel
+	}
+	return prefix + channel
+}
+
+// redisSubscribe streams the messages of a channel, or of the channels matching a pattern, as events:
+//
+//	event: message
+//	data: {"channel":"news","message":"hello"}
+//
+// Messages of a pattern subscription also have the "pattern".
+func (h *Handler) redisSubscribe(w http.ResponseWriter, r *http.Request, pattern bool) {
+	name, channel := "SUBSCRIBE", strings.TrimPrefix(r.URL.Path, "/redis/subscribe/")
+	if pattern {
+		name, channel = "PSUBSCRIBE", strings.TrimPrefix(r.URL.Path, "/redis/psubscribe/")
+	}
+	if channel == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "ERR empty channel"})
+		return
+	}
+	key := requestApiKey(r)
+	err := h.redisACL.checkSubscribe(key, name)
+	if err != nil {
+		h.redisMetrics.reject(key, []interface{}{name})
+		writeJSON(w, http.StatusForbidden, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	prefix := h.redisPrefixes[key]
+	channel = subscribeChannel(prefix, channel, pattern)
+	command := []interface{}{name, channel}
+
+	ctx := r.Context()
+	var pubsub *redis.PubSub
+	if pattern {
+		pubsub = h.redis.PSubscribe(ctx, channel)
+	} else {
+		pubsub = h.redis.Subscribe(ctx, channel)
+	}
+	defer pubsub.Close()
+	// the subscription is confirmed before the stream starts, so no message is missed
+	_, err = pubsub.Receive(ctx)
+	h.redisMetrics.count(key, command, err)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	sse, err := startSSE(w)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	encode := base64Encoding(r)
+	messages := pubsub.Channel()
+	ticker := time.NewTicker(sseKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-h.drained:
+			return
+		case <-ticker.C:
+			err = sse.keepAlive()
+		case message, ok := <-messages:
+			if !ok {
+				return
+			}
+			data := map[string]interface{}{
+				"channel": strings.TrimPrefix(message.Channel, prefix),
+				"message": message.Payload,
+			}
+			if pattern {
+				data["pattern"] = strings.TrimPrefix(message.Pattern, prefix)
+			}
+			if encode {
+				data["message"] = encodeRedisResult(message.Payload)
+			}
+			err = sse.event("", "message", data)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// redisStream streams the entries of a stream that are added after the Last-Event-ID header,
+// the last_event_id query parameter or, without both, after the stream was opened:
+//
+//	id: 1526919030474-0
+//	event: message
+//	data: {"field":"value"}
+func (h *Handler) redisStream(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/redis/stream/")
+	if key == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "ERR empty stream key"})
+		return
+	}
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+	command, err := h.authorizeRedis(r, []interface{}{"XREAD", "STREAMS", key, "$"})
+	if err != nil {
+		h.redisMetrics.reject(requestApiKey(r), []interface{}{"XREAD"})
+		writeJSON(w, http.StatusForbidden, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	stream := command[2].(string)
+
+	ctx := r.Context()
+	if lastID == "" {
+		// XREAD with $ misses the entries added between two reads, so the stream starts after its last entry
+		entries, err := h.redis.XRevRangeN(ctx, stream, "+", "-", 1).Result()
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": err.Error()})
+			return
+		}
+		lastID = "0-0"
+		if len(entries) != 0 {
+			lastID = entries[0].ID
+		}
+	}
+	sse, err := startSSE(w)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": err.Error()})
+		return
+	}
+
+	encode := base64Encoding(r)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-h.drained:
+			return
+		default:
+		}
+		streams, err := h.redis.XRead(ctx, &redis.XReadArgs{
+			Streams: []string{stream, lastID},
+			Count:   100,
+			Block:   redisStreamBlock,
+		}).Result()
+		if errors.Is(err, redis.Nil) {
+			err = sse.keepAlive()
+			if err != nil {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				_ = sse.event("", "error", map[string]interface{}{"error": err.Error()})
+			}
+			return
+		}
+		for _, s := range streams {
+			for _, entry := range s.Messages {
+				values := entry.Values
+				if encode {
+					values = map[string]interface{}{}
+					for field, value := range entry.Values {
+						values[field] = encodeRedisResult(value)
+					}
+				}
+				err = sse.event(entry.ID, "message", values)
+				if err != nil {
+					return
+				}
+				lastID = entry.ID
+			}
+		}
+	}
+}
@@ -0,0 +1,1145 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gavv/httpexpect/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/require"
+)
+
+// redisStatus is a simple string reply, e.g. +OK
+type redisStatus string
+
+// fakeRedisServer speaks enough of the Redis protocol to test the REST API with a real go-redis client
+type fakeRedisServer struct {
+	listener net.Listener
+
+	mu          sync.Mutex
+	values      map[string]string
+	hashes      map[string]map[string]string
+	scripts     map[string]string
+	executed    []string
+	streams     map[string][]fakeStreamEntry
+	lastID      int64
+	subscribers map[*fakeRedisConn]bool
+	lists       map[string][]string
+	clients     int64
+	// blocked are the ids of the clients waiting in BLPOP, true once they are unblocked
+	blocked map[int64]bool
+}
+
+type fakeStreamEntry struct {
+	id     int64
+	fields []interface{}
+}
+
+// fakeRedisConn is a client connection, messages are published to it while it is subscribed
+type fakeRedisConn struct {
+	id       int64
+	mu       sync.Mutex
+	writer   *bufio.Writer
+	channels map[string]bool
+	patterns map[string]bool
+}
+
+func (c *fakeRedisConn) write(reply interface{}, flush bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeRedisReply(c.writer, reply)
+	if flush {
+		_ = c.writer.Flush()
+	}
+}
+
+func newFakeRedisServer(t *testing.T) *fakeRedisServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &fakeRedisServer{
+		listener:    listener,
+		values:      map[string]string{},
+		hashes:      map[string]map[string]string{},
+		scripts:     map[string]string{},
+		streams:     map[string][]fakeStreamEntry{},
+		subscribers: map[*fakeRedisConn]bool{},
+		lists:       map[string][]string{},
+		blocked:     map[int64]bool{},
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeRedisServer) client() *redis.Client {
+	return redis.NewClient(&redis.Options{Addr: s.listener.Addr().String()})
+}
+
+func (s *fakeRedisServer) serve(conn net.Conn) {
+	s.mu.Lock()
+	s.clients++
+	c := &fakeRedisConn{
+		id:       s.clients,
+		writer:   bufio.NewWriter(conn),
+		channels: map[string]bool{},
+		patterns: map[string]bool{},
+	}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.subscribers, c)
+		s.mu.Unlock()
+		_ = conn.Close()
+	}()
+	reader := bufio.NewReader(conn)
+	var queued [][]string
+	inMulti, aborted := false, false
+	for {
+		args, err := readRedisCommand(reader)
+		if err != nil {
+			return
+		}
+		var reply interface{}
+		name := strings.ToUpper(args[0])
+		switch {
+		case name == "SUBSCRIBE" || name == "PSUBSCRIBE":
+			s.mu.Lock()
+			s.subscribers[c] = true
+			for _, channel := range args[1:] {
+				if name == "SUBSCRIBE" {
+					c.channels[channel] = true
+				} else {
+					c.patterns[channel] = true
+				}
+			}
+			count := int64(len(c.channels) + len(c.patterns))
+			s.mu.Unlock()
+			for _, channel := range args[1:] {
+				c.write([]interface{}{strings.ToLower(name), channel, count}, true)
+			}
+			continue
+		case name == "CLIENT" && len(args) > 1 && strings.EqualFold(args[1], "ID"):
+			reply = c.id
+		case name == "CLIENT" && len(args) > 2 && strings.EqualFold(args[1], "UNBLOCK"):
+			id, _ := strconv.ParseInt(args[2], 10, 64)
+			s.mu.Lock()
+			_, ok := s.blocked[id]
+			if ok {
+				s.blocked[id] = true
+				reply = int64(1)
+			} else {
+				reply = int64(0)
+			}
+			s.mu.Unlock()
+		case name == "BLPOP" && !inMulti:
+			reply = s.blpop(c, args)
+		case name == "MULTI":
+			inMulti, aborted, queued = true, false, nil
+			reply = redisStatus("OK")
+		case name == "EXEC":
+			if aborted {
+				reply = fmt.Errorf("EXECABORT Transaction discarded because of previous errors.")
+			} else {
+				replies := make([]interface{}, len(queued))
+				for i, command := range queued {
+					replies[i] = s.execute(command)
+				}
+				reply = replies
+			}
+			inMulti, queued = false, nil
+		case inMulti:
+			if _, ok := fakeRedisCommands[name]; !ok {
+				aborted = true
+				reply = fmt.Errorf("ERR unknown command '%s'", args[0])
+				break
+			}
+			queued = append(queued, args)
+			reply = redisStatus("QUEUED")
+		default:
+			reply = s.execute(args)
+		}
+		c.write(reply, reader.Buffered() == 0)
+	}
+}
+
+var fakeRedisCommands = map[string]func(s *fakeRedisServer, args []string) interface{}{
+	"PING": func(s *fakeRedisServer, args []string) interface{} {
+		return redisStatus("PONG")
+	},
+	"SET": func(s *fakeRedisServer, args []string) interface{} {
+		s.values[args[1]] = args[2]
+		return redisStatus("OK")
+	},
+	"GET": func(s *fakeRedisServer, args []string) interface{} {
+		value, ok := s.values[args[1]]
+		if !ok {
+			return nil
+		}
+		return value
+	},
+	"DEL": func(s *fakeRedisServer, args []string) interface{} {
+		deleted := int64(0)
+		for _, key := range args[1:] {
+			if _, ok := s.values[key]; ok {
+				delete(s.values, key)
+				deleted++
+			}
+		}
+		return deleted
+	},
+	"INCR": func(s *fakeRedisServer, args []string) interface{} {
+		n, err := strconv.ParseInt(s.values[args[1]], 10, 64)
+		if err != nil && s.values[args[1]] != "" {
+			return fmt.Errorf("ERR value is not an integer or out of range")
+		}
+		s.values[args[1]] = strconv.FormatInt(n+1, 10)
+		return n + 1
+	},
+	"MGET": func(s *fakeRedisServer, args []string) interface{} {
+		values := make([]interface{}, 0, len(args)-1)
+		for _, key := range args[1:] {
+			if value, ok := s.values[key]; ok {
+				values = append(values, value)
+			} else {
+				values = append(values, nil)
+			}
+		}
+		return values
+	},
+	"KEYS": func(s *fakeRedisServer, args []string) interface{} {
+		return s.keys(args[1])
+	},
+	"PUBLISH": func(s *fakeRedisServer, args []string) interface{} {
+		received := int64(0)
+		for c := range s.subscribers {
+			if c.channels[args[1]] {
+				c.write([]interface{}{"message", args[1], args[2]}, true)
+				received++
+			}
+			for pattern := range c.patterns {
+				if ok, _ := path.Match(pattern, args[1]); ok {
+					c.write([]interface{}{"pmessage", pattern, args[1], args[2]}, true)
+					received++
+				}
+			}
+		}
+		return received
+	},
+	// XADD key * field value [field value ...], the ids are a sequence
+	"XADD": func(s *fakeRedisServer, args []string) interface{} {
+		s.lastID++
+		entry := fakeStreamEntry{id: s.lastID}
+		for _, arg := range args[3:] {
+			entry.fields = append(entry.fields, arg)
+		}
+		s.streams[args[1]] = append(s.streams[args[1]], entry)
+		return fmt.Sprintf("%d-0", entry.id)
+	},
+	// XREAD [COUNT count] [BLOCK ms] STREAMS key id, blocking is done by execute
+	"XREAD": func(s *fakeRedisServer, args []string) interface{} {
+		key := args[len(args)-2]
+		after, _ := strconv.ParseInt(strings.TrimSuffix(args[len(args)-1], "-0"), 10, 64)
+		var entries []interface{}
+		for _, entry := range s.streams[key] {
+			if entry.id > after {
+				entries = append(entries, entry.reply())
+			}
+		}
+		if len(entries) == 0 {
+			return nil
+		}
+		return []interface{}{[]interface{}{key, entries}}
+	},
+	// XREVRANGE key + - COUNT 1
+	"XREVRANGE": func(s *fakeRedisServer, args []string) interface{} {
+		entries := s.streams[args[1]]
+		if len(entries) == 0 {
+			return []interface{}{}
+		}
+		return []interface{}{entries[len(entries)-1].reply()}
+	},
+	"HSET": func(s *fakeRedisServer, args []string) interface{} {
+		if s.hashes[args[1]] == nil {
+			s.hashes[args[1]] = map[string]string{}
+		}
+		added := int64(0)
+		for i := 2; i < len(args)-1; i += 2 {
+			if _, ok := s.hashes[args[1]][args[i]]; !ok {
+				added++
+			}
+			s.hashes[args[1]][args[i]] = args[i+1]
+		}
+		return added
+	},
+	"HGET": func(s *fakeRedisServer, args []string) interface{} {
+		value, ok := s.hashes[args[1]][args[2]]
+		if !ok {
+			return nil
+		}
+		return value
+	},
+	"HGETALL": func(s *fakeRedisServer, args []string) interface{} {
+		fields := []interface{}{}
+		for field, value := range s.hashes[args[1]] {
+			fields = append(fields, field, value)
+		}
+		return fields
+	},
+	"HDEL": func(s *fakeRedisServer, args []string) interface{} {
+		deleted := int64(0)
+		for _, field := range args[2:] {
+			if _, ok := s.hashes[args[1]][field]; ok {
+				delete(s.hashes[args[1]], field)
+				deleted++
+			}
+		}
+		return deleted
+	},
+	"EVAL": func(s *fakeRedisServer, args []string) interface{} {
+		return s.eval(args[1], args[3:])
+	},
+	"EVALSHA": func(s *fakeRedisServer, args []string) interface{} {
+		script, ok := s.scripts[args[1]]
+		if !ok {
+			return fmt.Errorf("NOSCRIPT No matching script. Please use EVAL.")
+		}
+		return s.eval(script, args[3:])
+	},
+	"SCRIPT": func(s *fakeRedisServer, args []string) interface{} {
+		switch strings.ToUpper(args[1]) {
+		case "LOAD":
+			if strings.Contains(args[2], "syntax error") {
+				return fmt.Errorf("ERR Error compiling script")
+			}
+			sum := sha1.Sum([]byte(args[2]))
+			s.scripts[hex.EncodeToString(sum[:])] = args[2]
+			return hex.EncodeToString(sum[:])
+		case "FLUSH":
+			s.scripts = map[string]string{}
+			return redisStatus("OK")
+		}
+		return fmt.Errorf("ERR unknown subcommand")
+	},
+	"RPUSH": func(s *fakeRedisServer, args []string) interface{} {
+		s.lists[args[1]] = append(s.lists[args[1]], args[2:]...)
+		return int64(len(s.lists[args[1]]))
+	},
+	"LLEN": func(s *fakeRedisServer, args []string) interface{} {
+		return int64(len(s.lists[args[1]]))
+	},
+	// DEBUG SLEEP seconds
+	"DEBUG": func(s *fakeRedisServer, args []string) interface{} {
+		seconds, _ := strconv.ParseFloat(args[2], 64)
+		time.Sleep(time.Duration(seconds * float64(time.Second)))
+		return redisStatus("OK")
+	},
+	// SCAN returns all keys at once
+	"SCAN": func(s *fakeRedisServer, args []string) interface{} {
+		pattern := "*"
+		for i := 2; i < len(args)-1; i++ {
+			if strings.EqualFold(args[i], "MATCH") {
+				pattern = args[i+1]
+			}
+		}
+		return []interface{}{"0", s.keys(pattern)}
+	},
+}
+
+// blpop pops the first element of the lists of BLPOP key [key ...] timeout,
+// it waits until an element is pushed, the timeout is over or the client is unblocked
+func (s *fakeRedisServer) blpop(c *fakeRedisConn, args []string) interface{} {
+	seconds, _ := strconv.ParseFloat(args[len(args)-1], 64)
+	deadline := time.Now().Add(time.Duration(seconds * float64(time.Second)))
+	s.mu.Lock()
+	s.blocked[c.id] = false
+	defer func() {
+		delete(s.blocked, c.id)
+		s.mu.Unlock()
+	}()
+	for {
+		for _, key := range args[1 : len(args)-1] {
+			if list := s.lists[key]; len(list) != 0 {
+				s.lists[key] = list[1:]
+				return []interface{}{key, list[0]}
+			}
+		}
+		if s.blocked[c.id] || seconds != 0 && time.Now().After(deadline) {
+			return nil
+		}
+		s.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		s.mu.Lock()
+	}
+}
+
+// isBlocked reports whether a client waits in BLPOP
+func (s *fakeRedisServer) isBlocked() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.blocked) != 0
+}
+
+// eval loads script, scripts can't be run, they return their keys and arguments
+func (s *fakeRedisServer) eval(script string, keysAndArgs []string) interface{} {
+	if strings.Contains(script, "syntax error") {
+		return fmt.Errorf("ERR Error compiling script")
+	}
+	sum := sha1.Sum([]byte(script))
+	s.scripts[hex.EncodeToString(sum[:])] = script
+	result := []interface{}{}
+	for _, arg := range keysAndArgs {
+		result = append(result, arg)
+	}
+	return result
+}
+
+func (s *fakeRedisServer) keys(pattern string) []interface{} {
+	var keys []string
+	for key := range s.values {
+		if ok, _ := path.Match(pattern, key); ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	result := []interface{}{}
+	for _, key := range keys {
+		result = append(result, key)
+	}
+	return result
+}
+
+func (e fakeStreamEntry) reply() interface{} {
+	return []interface{}{fmt.Sprintf("%d-0", e.id), e.fields}
+}
+
+func (s *fakeRedisServer) execute(args []string) interface{} {
+	command, ok := fakeRedisCommands[strings.ToUpper(args[0])]
+	if !ok {
+		return fmt.Errorf("ERR unknown command '%s'", args[0])
+	}
+	// BLOCK ms waits for a reply that isn't nil
+	var deadline time.Time
+	for i := 1; i < len(args)-1; i++ {
+		if strings.EqualFold(args[i], "BLOCK") {
+			ms, _ := strconv.Atoi(args[i+1])
+			deadline = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+	}
+	for {
+		s.mu.Lock()
+		s.executed = append(s.executed, strings.ToUpper(args[0]))
+		reply := command(s, args)
+		s.mu.Unlock()
+		if reply != nil || time.Now().After(deadline) {
+			return reply
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// readRedisCommand reads a command sent as an array of bulk strings
+func readRedisCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("unexpected command %q", line)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err = reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		_, err = io.ReadFull(reader, data)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:size])
+	}
+	return args, nil
+}
+
+func writeRedisReply(w *bufio.Writer, reply interface{}) {
+	switch reply := reply.(type) {
+	case nil:
+		_, _ = w.WriteString("$-1\r\n")
+	case redisStatus:
+		_, _ = fmt.Fprintf(w, "+%s\r\n", reply)
+	case error:
+		_, _ = fmt.Fprintf(w, "-%s\r\n", reply)
+	case int64:
+		_, _ = fmt.Fprintf(w, ":%d\r\n", reply)
+	case string:
+		_, _ = fmt.Fprintf(w, "$%d\r\n%s\r\n", len(reply), reply)
+	case []interface{}:
+		_, _ = fmt.Fprintf(w, "*%d\r\n", len(reply))
+		for _, item := range reply {
+			writeRedisReply(w, item)
+		}
+	}
+}
+
+func newRedisTestServer(t *testing.T, options Options) *httptest.Server {
+	fakeDB := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(fakeDB.Close)
+	options.ApiKey = "key"
+	options.QueryEngineURL = fakeDB.URL
+	options.QueryEngineSdlURL = fakeDB.URL + "/sdl"
+	options.HealthEndpoint = "/health"
+	options.MetricsEndpoint = "/metrics"
+	options.ReadLimitSeconds = 10000
+	options.WriteLimitSeconds = 2000
+
+	fakeAPI := httptest.NewServer(NewHandler(options))
+	t.Cleanup(fakeAPI.Close)
+	return fakeAPI
+}
+
+func newRedisTestAPI(t *testing.T, options Options) *httpexpect.Expect {
+	fakeAPI := newRedisTestServer(t, options)
+	return httpexpect.WithConfig(httpexpect.Config{
+		BaseURL: fakeAPI.URL,
+		Client: &http.Client{
+			Jar:     httpexpect.NewJar(),
+			Timeout: time.Second * 2,
+		},
+		Reporter: httpexpect.NewRequireReporter(t),
+	})
+}
+
+func TestRedis(t *testing.T) {
+	e := newRedisTestAPI(t, Options{Redis: newFakeRedisServer(t).client()})
+
+	e.GET("/redis/get/foo").Expect().Status(http.StatusUnauthorized)
+	e.GET("/redis/set/foo/bar").WithHeader("Authorization", "Bearer key").
+		Expect().Status(http.StatusOK).JSON().Equal(map[string]interface{}{"result": "OK"})
+	e.POST("/redis").WithHeader("Authorization", "Bearer key").WithJSON([]string{"GET", "foo"}).
+		Expect().Status(http.StatusOK).JSON().Equal(map[string]interface{}{"result": "bar"})
+	e.GET("/redis/get/missing").WithHeader("Authorization", "Bearer key").
+		Expect().Status(http.StatusOK).JSON().Equal(map[string]interface{}{"result": nil})
+	e.GET("/redis/flushall").WithHeader("Authorization", "Bearer key").
+		Expect().Status(http.StatusBadRequest).JSON().Object().ContainsKey("error")
+}
+
+func TestRedisPipeline(t *testing.T) {
+	e := newRedisTestAPI(t, Options{Redis: newFakeRedisServer(t).client()})
+
+	e.POST("/redis/pipeline").WithHeader("Authorization", "Bearer key").
+		WithJSON([][]interface{}{{"SET", "foo", "bar"}, {"INCR", "foo"}, {"GET", "foo"}, {"GET", "missing"}, {"INCR", "n"}}).
+		Expect().Status(http.StatusOK).JSON().Equal([]interface{}{
+		map[string]interface{}{"result": "OK"},
+		map[string]interface{}{"error": "ERR value is not an integer or out of range"},
+		map[string]interface{}{"result": "bar"},
+		map[string]interface{}{"result": nil},
+		map[string]interface{}{"result": 1},
+	})
+	e.POST("/redis/pipeline").WithHeader("Authorization", "Bearer key").WithJSON([][]interface{}{}).
+		Expect().Status(http.StatusBadRequest).JSON().Object().ContainsKey("error")
+}
+
+func TestRedisMultiExec(t *testing.T) {
+	e := newRedisTestAPI(t, Options{Redis: newFakeRedisServer(t).client()})
+
+	e.POST("/redis/multi-exec").WithHeader("Authorization", "Bearer key").
+		WithJSON([][]interface{}{{"SET", "foo", "1"}, {"INCR", "foo"}, {"MGET", "foo", "missing"}}).
+		Expect().Status(http.StatusOK).JSON().Equal([]interface{}{
+		map[string]interface{}{"result": "OK"},
+		map[string]interface{}{"result": 2},
+		map[string]interface{}{"result": []interface{}{"2", nil}},
+	})
+
+	// a command that can't be queued discards the whole transaction
+	e.POST("/redis/multi-exec").WithHeader("Authorization", "Bearer key").
+		WithJSON([][]interface{}{{"SET", "foo", "3"}, {"NOPE"}}).
+		Expect().Status(http.StatusBadRequest).JSON().Object().Value("error").String().Contains("EXECABORT")
+	e.POST("/redis").WithHeader("Authorization", "Bearer key").WithJSON([]string{"GET", "foo"}).
+		Expect().Status(http.StatusOK).JSON().Equal(map[string]interface{}{"result": "2"})
+}
+
+func TestRedisBase64Encoding(t *testing.T) {
+	e := newRedisTestAPI(t, Options{Redis: newFakeRedisServer(t).client()})
+
+	e.POST("/redis").WithHeader("Authorization", "Bearer key").WithHeader("Upstash-Encoding", "base64").
+		WithJSON([]string{"SET", "foo", "héllo"}).
+		Expect().Status(http.StatusOK).JSON().Equal(map[string]interface{}{"result": "OK"})
+	e.POST("/redis").WithHeader("Authorization", "Bearer key").WithHeader("Upstash-Encoding", "base64").
+		WithJSON([]string{"GET", "foo"}).
+		Expect().Status(http.StatusOK).JSON().Equal(map[string]interface{}{"result": "aMOpbGxv"})
+	e.POST("/redis/pipeline").WithHeader("Authorization", "Bearer key").WithHeader("Upstash-Encoding", "base64").
+		WithJSON([][]interface{}{{"MGET", "foo", "missing"}, {"INCR", "n"}, {"GET", "missing"}}).
+		Expect().Status(http.StatusOK).JSON().Equal([]interface{}{
+		map[string]interface{}{"result": []interface{}{"aMOpbGxv", nil}},
+		map[string]interface{}{"result": 1},
+		map[string]interface{}{"result": nil},
+	})
+	// without the header results are returned as is
+	e.POST("/redis").WithHeader("Authorization", "Bearer key").WithJSON([]string{"MGET", "n"}).
+		Expect().Status(http.StatusOK).JSON().Equal(map[string]interface{}{"result": []interface{}{"1"}})
+}
+
+func TestRedisACL(t *testing.T) {
+	e := newRedisTestAPI(t, Options{
+		Redis:               newFakeRedisServer(t).client(),
+		RedisScopes:         []string{RedisScopeRead, RedisScopeWrite},
+		RedisApiKeys:        map[string][]string{"reader": {RedisScopeRead}, "admin": RedisScopes},
+		RedisDeniedCommands: []string{"flushall"},
+	})
+
+	e.POST("/redis").WithHeader("Authorization", "Bearer key").WithJSON([]string{"SET", "foo", "bar"}).
+		Expect().Status(http.StatusOK)
+	e.POST("/redis").WithHeader("Authorization", "Bearer reader").WithJSON([]string{"GET", "foo"}).
+		Expect().Status(http.StatusOK).JSON().Equal(map[string]interface{}{"result": "bar"})
+	e.POST("/redis").WithHeader("Authorization", "Bearer reader").WithJSON([]string{"SET", "foo", "baz"}).
+		Expect().Status(http.StatusForbidden).JSON().Object().Value("error").String().Contains("requires the write scope")
+	e.GET("/redis/keys/*").WithHeader("Authorization", "Bearer key").
+		Expect().Status(http.StatusForbidden).JSON().Object().Value("error").String().Contains("requires the admin scope")
+	e.GET("/redis/keys/*").WithHeader("Authorization", "Bearer admin").
+		Expect().Status(http.StatusOK).JSON().Equal(map[string]interface{}{"result": []interface{}{"foo"}})
+	e.GET("/redis/flushall").WithHeader("Authorization", "Bearer admin").
+		Expect().Status(http.StatusForbidden).JSON().Object().Value("error").String().Contains("REDIS_DENIED_COMMANDS")
+
+	// scripts can call any command, so they need the admin scope and must be allowed explicitly while commands are restricted
+	e.POST("/redis").WithHeader("Authorization", "Bearer key").WithJSON([]interface{}{"EVAL", "return redis.call('FLUSHALL')", 0}).
+		Expect().Status(http.StatusForbidden).JSON().Object().Value("error").String().Contains("REDIS_ALLOWED_COMMANDS")
+	e.POST("/redis").WithHeader("Authorization", "Bearer admin").WithJSON([]interface{}{"SCRIPT", "LOAD", "return 1"}).
+		Expect().Status(http.StatusForbidden).JSON().Object().Value("error").String().Contains("REDIS_ALLOWED_COMMANDS")
+
+	// subscribing would switch a pooled connection into subscriber mode
+	e.POST("/redis").WithHeader("Authorization", "Bearer reader").WithJSON([]string{"SUBSCRIBE", "news"}).
+		Expect().Status(http.StatusForbidden).JSON().Object().Value("error").String().Contains("subscribe endpoints")
+	e.POST("/redis/psubscribe/*").WithHeader("Authorization", "Bearer admin").
+		Expect().Status(http.StatusForbidden)
+	e.POST("/redis/multi-exec").WithHeader("Authorization", "Bearer admin").
+		WithJSON([][]interface{}{{"GET", "foo"}, {"UNSUBSCRIBE"}}).
+		Expect().Status(http.StatusForbidden)
+
+	// nothing in a pipeline is executed if one command is not allowed
+	e.POST("/redis/pipeline").WithHeader("Authorization", "Bearer reader").
+		WithJSON([][]interface{}{{"GET", "foo"}, {"DEL", "foo"}}).
+		Expect().Status(http.StatusForbidden)
+	e.POST("/redis").WithHeader("Authorization", "Bearer reader").WithJSON([]string{"GET", "foo"}).
+		Expect().Status(http.StatusOK).JSON().Equal(map[string]interface{}{"result": "bar"})
+
+	// the Redis API keys can't be used for the query engine
+	e.POST("/").WithHeader("Authorization", "Bearer reader").WithHeader("Content-Type", "application/json").
+		WithBytes([]byte(`{"query":"{}"}`)).Expect().Status(http.StatusUnauthorized)
+
+	allowlisted := newRedisTestAPI(t, Options{
+		Redis:                newFakeRedisServer(t).client(),
+		RedisAllowedCommands: []string{"GET"},
+	})
+	allowlisted.POST("/redis").WithHeader("Authorization", "Bearer key").WithJSON([]string{"SET", "foo", "bar"}).
+		Expect().Status(http.StatusForbidden).JSON().Object().Value("error").String().Contains("REDIS_ALLOWED_COMMANDS")
+
+	scripts := newRedisTestAPI(t, Options{
+		Redis:                newFakeRedisServer(t).client(),
+		RedisApiKeys:         map[string][]string{"writer": {RedisScopeRead, RedisScopeWrite}},
+		RedisAllowedCommands: []string{"GET", "EVAL"},
+	})
+	scripts.POST("/redis").WithHeader("Authorization", "Bearer writer").WithJSON([]interface{}{"EVAL", "return 1", 0}).
+		Expect().Status(http.StatusForbidden).JSON().Object().Value("error").String().Contains("requires the admin scope")
+	scripts.POST("/redis").WithHeader("Authorization", "Bearer key").WithJSON([]interface{}{"EVAL", "return 1", 0}).
+		Expect().Status(http.StatusOK)
+}
+
+func TestRedisKeyPrefix(t *testing.T) {
+	server := newFakeRedisServer(t)
+	e := newRedisTestAPI(t, Options{
+		Redis:            server.client(),
+		RedisApiKeys:     map[string][]string{"app-a": RedisScopes, "app-b": RedisScopes},
+		RedisKeyPrefixes: map[string]string{"app-a": "a:", "app-b": "b:"},
+	})
+
+	e.POST("/redis").WithHeader("Authorization", "Bearer app-a").WithJSON([]string{"SET", "foo", "a"}).
+		Expect().Status(http.StatusOK)
+	e.POST("/redis/pipeline").WithHeader("Authorization", "Bearer app-b").
+		WithJSON([][]interface{}{{"SET", "foo", "b"}, {"SET", "bar", "b"}}).
+		Expect().Status(http.StatusOK)
+	e.POST("/redis").WithHeader("Authorization", "Bearer key").WithJSON([]string{"SET", "foo", "shared"}).
+		Expect().Status(http.StatusOK)
+	require.Equal(t, map[string]string{"a:foo": "a", "b:foo": "b", "b:bar": "b", "foo": "shared"}, server.values)
+
+	e.POST("/redis").WithHeader("Authorization", "Bearer app-a").WithJSON([]string{"MGET", "foo", "bar"}).
+		Expect().Status(http.StatusOK).JSON().Equal(map[string]interface{}{"result": []interface{}{"a", nil}})
+	e.GET("/redis/keys/*").WithHeader("Authorization", "Bearer app-b").
+		Expect().Status(http.StatusOK).JSON().Equal(map[string]interface{}{"result": []interface{}{"bar", "foo"}})
+	e.POST("/redis/pipeline").WithHeader("Authorization", "Bearer app-a").
+		WithJSON([][]interface{}{{"SCAN", 0}, {"SCAN", 0, "MATCH", "b*"}}).
+		Expect().Status(http.StatusOK).JSON().Equal([]interface{}{
+		map[string]interface{}{"result": []interface{}{"0", []interface{}{"foo"}}},
+		map[string]interface{}{"result": []interface{}{"0", []interface{}{}}},
+	})
+	e.POST("/redis").WithHeader("Authorization", "Bearer app-b").WithJSON([]string{"DEL", "foo", "bar"}).
+		Expect().Status(http.StatusOK).JSON().Equal(map[string]interface{}{"result": 2})
+	e.GET("/redis/get/foo").WithHeader("Authorization", "Bearer app-a").
+		Expect().Status(http.StatusOK).JSON().Equal(map[string]interface{}{"result": "a"})
+
+	// commands on the keys of all tenants can't be namespaced
+	e.GET("/redis/flushall").WithHeader("Authorization", "Bearer app-a").
+		Expect().Status(http.StatusForbidden).JSON().Object().Value("error").String().Contains("key prefix")
+	e.GET("/redis/dbsize").WithHeader("Authorization", "Bearer app-a").
+		Expect().Status(http.StatusForbidden)
+	e.POST("/redis").WithHeader("Authorization", "Bearer app-a").WithJSON([]interface{}{"EVAL", "return redis.call('GET', 'b:foo')", 0}).
+		Expect().Status(http.StatusForbidden).JSON().Object().Value("error").String().Contains("named script")
+}
+
+func TestPrefixKeys(t *testing.T) {
+	for _, tc := range []struct {
+		command  []interface{}
+		prefixed []interface{}
+	}{
+		{[]interface{}{"get", "k"}, []interface{}{"get", "p:k"}},
+		{[]interface{}{"MSET", "k1", "v1", "k2", "v2"}, []interface{}{"MSET", "p:k1", "v1", "p:k2", "v2"}},
+		{[]interface{}{"BLPOP", "k1", "k2", 0.0}, []interface{}{"BLPOP", "p:k1", "p:k2", 0.0}},
+		{[]interface{}{"ZUNIONSTORE", "dst", "2", "k1", "k2", "WEIGHTS", "1", "2"}, []interface{}{"ZUNIONSTORE", "p:dst", "2", "p:k1", "p:k2", "WEIGHTS", "1", "2"}},
+		{[]interface{}{"XREAD", "COUNT", "1", "STREAMS", "s1", "s2", "0", "0"}, []interface{}{"XREAD", "COUNT", "1", "STREAMS", "p:s1", "p:s2", "0", "0"}},
+		{[]interface{}{"RENAME", "k1", "k2"}, []interface{}{"RENAME", "p:k1", "p:k2"}},
+		{[]interface{}{"KEYS", "user:*"}, []interface{}{"KEYS", "p:user:*"}},
+		{[]interface{}{"SCAN", "0", "COUNT", "10"}, []interface{}{"SCAN", "0", "COUNT", "10", "MATCH", "p:*"}},
+		{[]interface{}{"SCAN", "0", "MATCH", "a", "MATCH", "*"}, []interface{}{"SCAN", "0", "MATCH", "p:a", "MATCH", "p:*"}},
+		{[]interface{}{"SCAN", "0", "match", "a", "COUNT", "10", "MATCH", "*"}, []interface{}{"SCAN", "0", "match", "p:a", "COUNT", "10", "MATCH", "p:*"}},
+		{[]interface{}{"PING"}, []interface{}{"PING"}},
+	} {
+		prefixed, err := prefixKeys("p:", tc.command)
+		require.NoError(t, err)
+		require.Equal(t, tc.prefixed, prefixed)
+	}
+
+	prefixed, err := prefixKeys("[p]", []interface{}{"KEYS", "*"})
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{"KEYS", `\[p\]*`}, prefixed)
+
+	// scripts could access the keys of other prefixes with redis.call
+	for _, command := range [][]interface{}{
+		{"EVAL", "return redis.call('GET', 'foo')", 0},
+		{"evalsha", "e0e1f9fabfc9d4800c877a703b823ac0578ff8db", 1, "k"},
+	} {
+		_, err = prefixKeys("p:", command)
+		require.Error(t, err)
+	}
+}
+
+// openEventStream opens the event stream at url, the stream is closed at the end of the test
+func openEventStream(t *testing.T, url string, header http.Header) *bufio.Reader {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	require.NoError(t, err)
+	req.Header = header
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = resp.Body.Close()
+	})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	return bufio.NewReader(resp.Body)
+}
+
+// readEvent returns the fields of the next event, skipping comments
+func readEvent(t *testing.T, reader *bufio.Reader) map[string]string {
+	event := map[string]string{}
+	for {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && len(event) != 0:
+			return event
+		case line == "" || strings.HasPrefix(line, ":"):
+		default:
+			field, value, _ := strings.Cut(line, ": ")
+			event[field] = value
+		}
+	}
+}
+
+func TestRedisSubscribe(t *testing.T) {
+	server := newFakeRedisServer(t)
+	options := Options{
+		Redis:            server.client(),
+		RedisApiKeys:     map[string][]string{"app": {RedisScopeRead, RedisScopeWrite}, "writer": {RedisScopeWrite}},
+		RedisKeyPrefixes: map[string]string{"app": "app:"},
+	}
+	api := newRedisTestServer(t, options)
+	e := httpexpect.New(t, api.URL)
+	auth := func(key string) http.Header {
+		return http.Header{"Authorization": {"Bearer " + key}}
+	}
+
+	news := openEventStream(t, api.URL+"/redis/subscribe/news", auth("key"))
+	e.POST("/redis").WithHeader("Authorization", "Bearer key").WithJSON([]string{"PUBLISH", "news", "hello"}).
+		Expect().Status(http.StatusOK).JSON().Equal(map[string]interface{}{"result": 1})
+	require.Equal(t, map[string]string{"event": "message", "data": `{"channel":"news","message":"hello"}`}, readEvent(t, news))
+
+	// the channels of prefixed API keys are prefixed as well
+	pattern := openEventStream(t, api.URL+"/redis/psubscribe/n*", auth("app"))
+	e.POST("/redis").WithHeader("Authorization", "Bearer key").WithJSON([]string{"PUBLISH", "news", "not for app"}).
+		Expect().Status(http.StatusOK).JSON().Equal(map[string]interface{}{"result": 1})
+	e.POST("/redis").WithHeader("Authorization", "Bearer app").WithJSON([]string{"PUBLISH", "news", "for app"}).
+		Expect().Status(http.StatusOK).JSON().Equal(map[string]interface{}{"result": 1})
+	require.Equal(t, map[string]string{
+		"event": "message",
+		"data":  `{"channel":"news","message":"for app","pattern":"n*"}`,
+	}, readEvent(t, pattern))
+
+	e.GET("/redis/subscribe/news").WithHeader("Authorization", "Bearer writer").
+		Expect().Status(http.StatusForbidden).JSON().Object().Value("error").String().Contains("read scope")
+	e.GET("/redis/subscribe/news").Expect().Status(http.StatusUnauthorized)
+}
+
+func TestRedisStream(t *testing.T) {
+	keepAlive, block := sseKeepAlive, redisStreamBlock
+	sseKeepAlive, redisStreamBlock = 50*time.Millisecond, 50*time.Millisecond
+	t.Cleanup(func() {
+		sseKeepAlive, redisStreamBlock = keepAlive, block
+	})
+	server := newFakeRedisServer(t)
+	api := newRedisTestServer(t, Options{Redis: server.client()})
+	e := httpexpect.New(t, api.URL)
+	auth := http.Header{"Authorization": {"Bearer key"}}
+	xadd := func(value string) string {
+		return e.POST("/redis").WithHeader("Authorization", "Bearer key").
+			WithJSON([]string{"XADD", "events", "*", "type", value}).
+			Expect().Status(http.StatusOK).JSON().Object().Value("result").String().Raw()
+	}
+
+	first := xadd("created")
+	// without a last event id, only new entries are streamed
+	events := openEventStream(t, api.URL+"/redis/stream/events", auth)
+	second := xadd("updated")
+	require.Equal(t, map[string]string{"id": second, "event": "message", "data": `{"type":"updated"}`}, readEvent(t, events))
+
+	// a reconnecting client resumes after the last event it received
+	header := auth.Clone()
+	header.Set("Last-Event-ID", first)
+	resumed := openEventStream(t, api.URL+"/redis/stream/events", header)
+	require.Equal(t, map[string]string{"id": second, "event": "message", "data": `{"type":"updated"}`}, readEvent(t, resumed))
+	third := xadd("deleted")
+	require.Equal(t, map[string]string{"id": third, "event": "message", "data": `{"type":"deleted"}`}, readEvent(t, resumed))
+	require.Equal(t, third, readEvent(t, events)["id"])
+}
+
+func TestRedisHealthCheck(t *testing.T) {
+	e := newRedisTestAPI(t, Options{Redis: newFakeRedisServer(t).client(), RedisHealthCheck: true})
+	e.GET("/health").WithHeader("Authorization", "Bearer key").Expect().Status(http.StatusOK).Body().Equal("OK")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, listener.Close())
+	unreachable := redis.NewClient(&redis.Options{Addr: listener.Addr().String(), MaxRetries: -1})
+	e = newRedisTestAPI(t, Options{Redis: unreachable, RedisHealthCheck: true})
+	e.GET("/health").WithHeader("Authorization", "Bearer key").
+		Expect().Status(http.StatusInternalServerError).Body().Equal("redis not reachable")
+	e = newRedisTestAPI(t, Options{Redis: unreachable})
+	e.GET("/health").WithHeader("Authorization", "Bearer key").Expect().Status(http.StatusOK)
+}
+
+func TestRedisPathCommand(t *testing.T) {
+	server := newFakeRedisServer(t)
+	api := newRedisTestServer(t, Options{Redis: server.client()})
+	e := httpexpect.New(t, api.URL)
+	get := func(path string) map[string]interface{} {
+		req, err := http.NewRequest(http.MethodGet, api.URL+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer key")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var response map[string]interface{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&response))
+		return response
+	}
+
+	// percent-encoded slashes and spaces are part of the value
+	require.Equal(t, map[string]interface{}{"result": "OK"}, get("/redis/set/path%2Fkey/a%2Fb%20c"))
+	require.Equal(t, map[string]interface{}{"result": "a/b c"}, get("/redis/get/path%2Fkey"))
+
+	// the body is the value
+	e.POST("/redis/set/body").WithHeader("Authorization", "Bearer key").WithText("line 1\nline/2").
+		Expect().Status(http.StatusOK)
+	require.Equal(t, "line 1\nline/2", server.values["body"])
+
+	// query parameters are arguments in their order, the API key is not
+	require.Equal(t, map[string]interface{}{"result": []interface{}{"a/b c", "line 1\nline/2", nil}},
+		get("/redis/mget/path%2Fkey?_token=key&body&unknown"))
+	command, err := parseRedisCommand(httptest.NewRequest(http.MethodGet, "/redis/set/key/value?EX=100&NX&api_key=key", nil))
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{"set", "key", "value", "EX", "100", "NX"}, command)
+
+	e.GET("/redis").WithHeader("Authorization", "Bearer key").Expect().Status(http.StatusBadRequest)
+}
+
+func TestRedisEval(t *testing.T) {
+	server := newFakeRedisServer(t)
+	e := newRedisTestAPI(t, Options{Redis: server.client()})
+	executed := func() []string {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		executed := server.executed
+		server.executed = nil
+		return executed
+	}
+	eval := []interface{}{"EVAL", "return {KEYS[1], ARGV[1]}", 1, "key", "value"}
+
+	e.POST("/redis").WithHeader("Authorization", "Bearer key").WithJSON(eval).
+		Expect().Status(http.StatusOK).JSON().Equal(map[string]interface{}{"result": []interface{}{"key", "value"}})
+	require.Equal(t, []string{"EVALSHA", "EVAL"}, executed())
+	e.POST("/redis").WithHeader("Authorization", "Bearer key").WithJSON(eval).
+		Expect().Status(http.StatusOK).JSON().Equal(map[string]interface{}{"result": []interface{}{"key", "value"}})
+	require.Equal(t, []string{"EVALSHA"}, executed())
+
+	// the proxy loads the scripts it knows again, e.g. after Redis restarted
+	sha := e.POST("/redis").WithHeader("Authorization", "Bearer key").WithJSON([]string{"SCRIPT", "LOAD", "return 1"}).
+		Expect().Status(http.StatusOK).JSON().Object().Value("result").String().Raw()
+	server.client().ScriptFlush(context.Background())
+	executed()
+	e.POST("/redis").WithHeader("Authorization", "Bearer key").WithJSON([]interface{}{"EVALSHA", sha, 0}).
+		Expect().Status(http.StatusOK)
+	require.Equal(t, []string{"EVALSHA", "EVAL"}, executed())
+	e.POST("/redis").WithHeader("Authorization", "Bearer key").WithJSON([]interface{}{"EVALSHA", strings.Repeat("0", 40), 0}).
+		Expect().Status(http.StatusBadRequest).JSON().Object().Value("error").String().Contains("NOSCRIPT")
+}
+
+func TestRedisNamedScripts(t *testing.T) {
+	server := newFakeRedisServer(t)
+	e := newRedisTestAPI(t, Options{
+		Redis:            server.client(),
+		AdminApiKey:      "admin",
+		RedisApiKeys:     map[string][]string{"app": {RedisScopeRead, RedisScopeWrite}, "reader": {RedisScopeRead}},
+		RedisKeyPrefixes: map[string]string{"app": "app:"},
+	})
+
+	e.PUT("/admin/redis/scripts/set-if-higher").WithHeader("Authorization", "Bearer key").
+		WithJSON(map[string]interface{}{"script": "return 1"}).Expect().Status(http.StatusUnauthorized)
+	script := e.PUT("/admin/redis/scripts/set-if-higher").WithHeader("Authorization", "Bearer admin").
+		WithJSON(map[string]interface{}{"script": "return {KEYS[1], ARGV[1]}", "keys": 1, "args": 1}).
+		Expect().Status(http.StatusOK).JSON().Object()
+	script.ValueEqual("name", "set-if-higher").ValueEqual("keys", 1).ValueEqual("args", 1)
+	script.Value("sha").String().Length().Equal(40)
+	e.PUT("/admin/redis/scripts/broken").WithHeader("Authorization", "Bearer admin").
+		WithJSON(map[string]interface{}{"script": "syntax error"}).Expect().Status(http.StatusBadRequest)
+	e.GET("/admin/redis/scripts").WithHeader("Authorization", "Bearer admin").
+		Expect().Status(http.StatusOK).JSON().Array().Length().Equal(1)
+
+	// the keys are prefixed like the keys of other commands
+	e.POST("/redis/script/set-if-higher").WithHeader("Authorization", "Bearer app").
+		WithJSON(map[string]interface{}{"keys": []string{"score"}, "args": []interface{}{10}}).
+		Expect().Status(http.StatusOK).JSON().Equal(map[string]interface{}{"result": []interface{}{"app:score", "10"}})
+	e.POST("/redis/script/set-if-higher").WithHeader("Authorization", "Bearer app").
+		WithJSON(map[string]interface{}{"keys": []string{"score", "other"}}).
+		Expect().Status(http.StatusBadRequest).JSON().Object().Value("error").String().
+		Equal("ERR script set-if-higher takes 1 keys and 1 args, got 2 keys and 0 args")
+	e.POST("/redis/script/set-if-higher").WithHeader("Authorization", "Bearer reader").
+		WithJSON(map[string]interface{}{"keys": []string{"score"}, "args": []interface{}{10}}).
+		Expect().Status(http.StatusForbidden)
+	e.POST("/redis/script/unknown").WithHeader("Authorization", "Bearer key").
+		Expect().Status(http.StatusNotFound)
+	e.POST("/redis/script/unknown").WithHeader("Authorization", "Bearer reader").
+		Expect().Status(http.StatusForbidden)
+
+	e.DELETE("/admin/redis/scripts/set-if-higher").WithHeader("Authorization", "Bearer admin").
+		Expect().Status(http.StatusNoContent)
+	e.DELETE("/admin/redis/scripts/set-if-higher").WithHeader("Authorization", "Bearer admin").
+		Expect().Status(http.StatusNotFound)
+	e.POST("/redis/script/set-if-higher").WithHeader("Authorization", "Bearer key").
+		WithJSON(map[string]interface{}{"keys": []string{"score"}, "args": []interface{}{10}}).
+		Expect().Status(http.StatusNotFound)
+}
+
+func TestRedisReservedKeys(t *testing.T) {
+	server := newFakeRedisServer(t)
+	e := newRedisTestAPI(t, Options{
+		Redis:             server.client(),
+		AdminApiKey:       "admin",
+		RedisScopes:       []string{RedisScopeRead, RedisScopeWrite},
+		RedisApiKeys:      map[string][]string{"app": {RedisScopeRead, RedisScopeWrite}},
+		RedisKeyPrefixes:  map[string]string{"app": "wunderbase:"},
+		RedisReservedKeys: []string{"wunderbase:migration", "wunderbase:migration:completed"},
+	})
+
+	// a write scope key can't register its own source as a named script
+	tampered := `{"name":"x","script":"return redis.call('FLUSHALL')","sha":"bogus","keys":0,"args":0}`
+	e.POST("/redis").WithHeader("Authorization", "Bearer key").WithJSON([]string{"HSET", "wunderbase:scripts", "x", tampered}).
+		Expect().Status(http.StatusForbidden).JSON().Object().Value("error").String().Equal("ERR key wunderbase:scripts is reserved by the proxy")
+	e.POST("/redis/pipeline").WithHeader("Authorization", "Bearer key").
+		WithJSON([][]string{{"GET", "foo"}, {"HSET", "wunderbase:scripts", "x", tampered}}).
+		Expect().Status(http.StatusForbidden)
+	e.POST("/redis/multi-exec").WithHeader("Authorization", "Bearer key").
+		WithJSON([][]string{{"DEL", "foo", "wunderbase:migration:completed"}}).
+		Expect().Status(http.StatusForbidden)
+	e.GET("/redis/set/wunderbase:migration/token").WithHeader("Authorization", "Bearer key").
+		Expect().Status(http.StatusForbidden)
+	// the key prefix can't be used to reach them either
+	e.POST("/redis").WithHeader("Authorization", "Bearer app").WithJSON([]string{"HSET", "scripts", "x", tampered}).
+		Expect().Status(http.StatusForbidden)
+
+	// a script changed outside of the admin API is not run
+	server.mu.Lock()
+	require.Empty(t, server.hashes["wunderbase:scripts"])
+	server.hashes["wunderbase:scripts"] = map[string]string{"x": tampered}
+	server.mu.Unlock()
+	e.POST("/redis/script/x").WithHeader("Authorization", "Bearer key").WithJSON(map[string]interface{}{}).
+		Expect().Status(http.StatusBadRequest).JSON().Object().Value("error").String().Equal("ERR script x doesn't match its SHA1")
+}
+
+func TestRedisTimeout(t *testing.T) {
+	e := newRedisTestAPI(t, Options{Redis: newFakeRedisServer(t).client(), RedisCommandTimeoutSeconds: 1})
+
+	start := time.Now()
+	e.POST("/redis").WithHeader("Authorization", "Bearer key").WithJSON([]interface{}{"DEBUG", "SLEEP", 1.5}).
+		Expect().Status(http.StatusGatewayTimeout).JSON().Equal(map[string]interface{}{"error": "ERR command timed out"})
+	require.Less(t, time.Since(start), 1400*time.Millisecond)
+	e.POST("/redis/pipeline").WithHeader("Authorization", "Bearer key").
+		WithJSON([][]interface{}{{"PING"}, {"DEBUG", "SLEEP", 1.5}}).
+		Expect().Status(http.StatusGatewayTimeout)
+
+	// blocking commands must time out before the command timeout
+	e.POST("/redis").WithHeader("Authorization", "Bearer key").WithJSON([]interface{}{"BLPOP", "list", 0}).
+		Expect().Status(http.StatusBadRequest).JSON().Object().Value("error").String().Contains("REDIS_ALLOW_BLOCKING_COMMANDS")
+	e.POST("/redis/pipeline").WithHeader("Authorization", "Bearer key").
+		WithJSON([][]interface{}{{"XREAD", "BLOCK", 5000, "STREAMS", "events", "$"}}).
+		Expect().Status(http.StatusBadRequest)
+	e.GET("/redis/brpop/list/0.5").WithHeader("Authorization", "Bearer key").
+		Expect().Status(http.StatusBadRequest).JSON().Object().Value("error").String().Contains("unknown command")
+}
+
+func TestRedisBlockingDisconnect(t *testing.T) {
+	server := newFakeRedisServer(t)
+	fakeAPI := newRedisTestServer(t, Options{Redis: server.client(), RedisAllowBlockingCommands: true})
+	e := httpexpect.WithConfig(httpexpect.Config{
+		BaseURL:  fakeAPI.URL,
+		Client:   &http.Client{Timeout: time.Second * 2},
+		Reporter: httpexpect.NewRequireReporter(t),
+	})
+
+	e.POST("/redis").WithHeader("Authorization", "Bearer key").WithJSON([]interface{}{"RPUSH", "jobs", "job-1"}).
+		Expect().Status(http.StatusOK)
+	e.POST("/redis").WithHeader("Authorization", "Bearer key").WithJSON([]interface{}{"BLPOP", "jobs", 0}).
+		Expect().Status(http.StatusOK).JSON().Equal(map[string]interface{}{"result": []interface{}{"jobs", "job-1"}})
+
+	// the client disconnects while BLPOP waits
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fakeAPI.URL+"/redis", strings.NewReader(`["BLPOP", "jobs", 0]`))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer key")
+	failed := make(chan error)
+	go func() {
+		_, err := http.DefaultClient.Do(req)
+		failed <- err
+	}()
+	require.Eventually(t, server.isBlocked, time.Second, 10*time.Millisecond)
+	cancel()
+	require.Error(t, <-failed)
+	require.Eventually(t, func() bool {
+		return !server.isBlocked()
+	}, time.Second, 10*time.Millisecond)
+
+	// the element pushed afterwards isn't popped by the abandoned BLPOP
+	e.POST("/redis").WithHeader("Authorization", "Bearer key").WithJSON([]interface{}{"RPUSH", "jobs", "job-2"}).
+		Expect().Status(http.StatusOK)
+	time.Sleep(50 * time.Millisecond)
+	e.POST("/redis").WithHeader("Authorization", "Bearer key").WithJSON([]interface{}{"LLEN", "jobs"}).
+		Expect().Status(http.StatusOK).JSON().Equal(map[string]interface{}{"result": 1})
+}
+
+func TestRedisContext(t *testing.T) {
+	h := NewHandler(Options{ReadLimitSeconds: 1, WriteLimitSeconds: 1, RedisCommandTimeoutSeconds: 10})
+	r := httptest.NewRequest(http.MethodPost, "/redis", nil)
+	_, _, err := h.redisContext(r, []interface{}{"BZPOPMIN", "key", 10})
+	require.Error(t, err)
+	ctx, cancel, err := h.redisContext(r, []interface{}{"GET", "key"}, []interface{}{"BLPOP", "key", 2.5})
+	require.NoError(t, err)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+	require.WithinDuration(t, time.Now().Add(12500*time.Millisecond), deadline, time.Second)
+
+	h = NewHandler(Options{ReadLimitSeconds: 1, WriteLimitSeconds: 1, RedisCommandTimeoutSeconds: 10, RedisAllowBlockingCommands: true})
+	ctx, cancel, err = h.redisContext(r, []interface{}{"XREAD", "BLOCK", 30000, "STREAMS", "events", "$"})
+	require.NoError(t, err)
+	defer cancel()
+	deadline, _ = ctx.Deadline()
+	require.WithinDuration(t, time.Now().Add(40*time.Second), deadline, time.Second)
+	ctx, cancel, err = h.redisContext(r, []interface{}{"BLPOP", "key", 0})
+	require.NoError(t, err)
+	defer cancel()
+	_, ok := ctx.Deadline()
+	require.False(t, ok)
+}
+
+func TestRedisMetrics(t *testing.T) {
+	e := newRedisTestAPI(t, Options{
+		Redis:                       newFakeRedisServer(t).client(),
+		RedisApiKeys:                map[string][]string{"reader": {RedisScopeRead}},
+		RedisSlowCommandThresholdMs: 100,
+	})
+
+	e.POST("/redis").WithHeader("Authorization", "Bearer key").WithJSON([]interface{}{"SET", "foo", "bar"}).
+		Expect().Status(http.StatusOK)
+	e.GET("/redis/get/missing").WithHeader("Authorization", "Bearer key").
+		Expect().Status(http.StatusOK)
+	e.POST("/redis").WithHeader("Authorization", "Bearer key").WithJSON([]interface{}{"FOO", "bar"}).
+		Expect().Status(http.StatusBadRequest)
+	e.GET("/redis/get/foo").WithHeader("Authorization", "Bearer reader").
+		Expect().Status(http.StatusOK)
+	e.GET("/redis/set/foo/baz").WithHeader("Authorization", "Bearer reader").
+		Expect().Status(http.StatusForbidden)
+	e.POST("/redis/pipeline").WithHeader("Authorization", "Bearer key").
+		WithJSON([][]interface{}{{"SET", "a", "1"}, {"INCR", "a"}}).
+		Expect().Status(http.StatusOK)
+	e.POST("/redis").WithHeader("Authorization", "Bearer key").WithJSON([]interface{}{"DEBUG", "SLEEP", 0.2}).
+		Expect().Status(http.StatusOK)
+
+	body := e.GET("/metrics").WithHeader("Authorization", "Bearer key").
+		Expect().Status(http.StatusOK).Body()
+	body.Contains(`wunderbase_redis_commands_total{command="SET",api_key="api_key"} 2`)
+	body.Contains(`wunderbase_redis_commands_total{command="GET",api_key="api_key"} 1`)
+	body.Contains(`wunderbase_redis_commands_total{command="GET",api_key="sha256:3d094196"} 1`)
+	body.Contains(`wunderbase_redis_commands_total{command="OTHER",api_key="api_key"} 2`)
+	body.Contains(`wunderbase_redis_command_errors_total{command="OTHER",api_key="api_key"} 1`)
+	body.NotContains(`wunderbase_redis_command_errors_total{command="GET"`)
+	body.Contains(`wunderbase_redis_commands_rejected_total{command="SET",api_key="sha256:3d094196"} 1`)
+	body.Contains(`wunderbase_redis_command_duration_seconds_count{command="PIPELINE"} 1`)
+	body.Contains(`wunderbase_redis_command_duration_seconds_count{command="SET"} 1`)
+	body.Contains(`wunderbase_redis_slow_commands_total{command="OTHER"} 1`)
+	body.NotContains(`wunderbase_redis_slow_commands_total{command="SET"}`)
+	body.NotContains("reader")
+}
@@ -0,0 +1,193 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// blockingCommands return how long a blocking command waits, 0 if it waits forever
+var blockingCommands = map[string]func(args []interface{}) (time.Duration, bool){
+	// BLPOP key [key ...] timeout
+	"BLPOP":      lastArgTimeout(time.Second),
+	"BRPOP":      lastArgTimeout(time.Second),
+	"BZPOPMAX":   lastArgTimeout(time.Second),
+	"BZPOPMIN":   lastArgTimeout(time.Second),
+	"BRPOPLPUSH": lastArgTimeout(time.Second),
+	"BLMOVE":     lastArgTimeout(time.Second),
+	// WAIT numreplicas timeout
+	"WAIT": lastArgTimeout(time.Millisecond),
+	// BLMPOP timeout numkeys key [key ...] LEFT|RIGHT
+	"BLMPOP": argTimeout(1, time.Second),
+	"BZMPOP": argTimeout(1, time.Second),
+	// XREAD [COUNT count] [BLOCK milliseconds] STREAMS key [key ...] id [id ...]
+	"XREAD":      blockOptionTimeout,
+	"XREADGROUP": blockOptionTimeout,
+}
+
+func lastArgTimeout(unit time.Duration) func(args []interface{}) (time.Duration, bool) {
+	return func(args []interface{}) (time.Duration, bool) {
+		return parseTimeout(args[len(args)-1], unit)
+	}
+}
+
+func argTimeout(i int, unit time.Duration) func(args []interface{}) (time.Duration, bool) {
+	return func(args []interface{}) (time.Duration, bool) {
+		if len(args) <= i {
+			return 0, false
+		}
+		return parseTimeout(args[i], unit)
+	}
+}
+
+func blockOptionTimeout(args []interface{}) (time.Duration, bool) {
+	for i := 1; i < len(args)-1; i++ {
+		if strings.EqualFold(fmt.Sprint(args[i]), "STREAMS") {
+			break
+		}
+		if strings.EqualFold(fmt.Sprint(args[i]), "BLOCK") {
+			return parseTimeout(args[i+1], time.Millisecond)
+		}
+	}
+	return 0, false
+}
+
+// parseTimeout returns the timeout of a blocking command, invalid timeouts are reported by Redis
+func parseTimeout(arg interface{}, unit time.Duration) (time.Duration, bool) {
+	timeout, err := strconv.ParseFloat(fmt.Sprint(arg), 64)
+	if err != nil || timeout < 0 {
+		return 0, false
+	}
+	return time.Duration(timeout * float64(unit)), true
+}
+
+// redisContext returns the context of the Redis commands of r, which ends when the client disconnects
+// or the command timeout is over. Blocking commands must time out within the command timeout,
+// unless blocking commands are allowed, then the context lasts for their timeout plus the command timeout.
+func (h *Handler) redisContext(r *http.Request, commands ...[]interface{}) (context.Context, context.CancelFunc, error) {
+	timeout := h.redisTimeout
+	for _, command := range commands {
+		name := strings.ToUpper(fmt.Sprint(command[0]))
+		blockingTimeout, ok := blockingCommands[name]
+		if !ok {
+			continue
+		}
+		block, ok := blockingTimeout(command)
+		if !ok {
+			continue
+		}
+		if !h.allowBlocking && (block == 0 || block >= h.redisTimeout) {
+			return nil, nil, fmt.Errorf("ERR %s must time out within %s, the REDIS_COMMAND_TIMEOUT_SECONDS, unless REDIS_ALLOW_BLOCKING_COMMANDS is set",
+				name, h.redisTimeout)
+		}
+		if block == 0 {
+			// blocks until the client disconnects
+			ctx, cancel := context.WithCancel(r.Context())
+			return ctx, cancel, nil
+		}
+		if block+h.redisTimeout > timeout {
+			timeout = block + h.redisTimeout
+		}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	return ctx, cancel, nil
+}
+
+// blockingCommand returns the first of commands that blocks, or nil
+func blockingCommand(commands ...[]interface{}) []interface{} {
+	for _, command := range commands {
+		blockingTimeout, ok := blockingCommands[strings.ToUpper(fmt.Sprint(command[0]))]
+		if !ok {
+			continue
+		}
+		if _, ok = blockingTimeout(command); ok {
+			return command
+		}
+	}
+	return nil
+}
+
+// blockingNode returns the client of the Redis node that runs command
+func (h *Handler) blockingNode(ctx context.Context, command []interface{}) (*redis.Client, error) {
+	switch client := h.redis.(type) {
+	case *redis.Client:
+		return client, nil
+	case *redis.ClusterClient:
+		name := strings.ToUpper(fmt.Sprint(command[0]))
+		keys := redisCommands[name].keyPositions(command)
+		if len(keys) == 0 || keys[0] >= len(command) {
+			return nil, fmt.Errorf("ERR %s without a key is not supported in cluster mode", name)
+		}
+		return client.MasterForKey(ctx, fmt.Sprint(command[keys[0]]))
+	}
+	return nil, fmt.Errorf("ERR blocking commands are not supported by the Redis client")
+}
+
+// runBlocking runs fn with a connection of its own for the blocking command, like runRedis.
+// go-redis keeps waiting for the reply after the client disconnected, so the command would still pop
+// an element that nobody receives. The connection is unblocked with CLIENT UNBLOCK instead when ctx is done.
+func (h *Handler) runBlocking(ctx context.Context, command []interface{}, fn func(conn *redis.Conn)) error {
+	node, err := h.blockingNode(ctx, command)
+	if err != nil {
+		return err
+	}
+	conn := node.Conn(context.Background())
+	id, err := conn.ClientID(ctx).Result()
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn(conn)
+	}()
+	select {
+	case <-done:
+		_ = conn.Close()
+		return nil
+	case <-ctx.Done():
+	}
+	unblockCtx, cancel := context.WithTimeout(context.Background(), h.redisTimeout)
+	defer cancel()
+	err = node.ClientUnblock(unblockCtx, id).Err()
+	if err != nil {
+		log.Printf("unblock Redis client %d: %v", id, err)
+	}
+	go func() {
+		<-done
+		_ = conn.Close()
+	}()
+	return ctx.Err()
+}
+
+// runRedis runs fn, but returns the error of ctx without waiting for fn if ctx is done first,
+// because go-redis stops at the deadline of ctx, but not when the client disconnects
+func runRedis(ctx context.Context, fn func()) error {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// writeRedisTimeout responds with an Upstash style error if ctx timed out,
+// nothing is written if the client disconnected
+func writeRedisTimeout(w http.ResponseWriter, ctx context.Context) {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		writeJSON(w, http.StatusGatewayTimeout, map[string]interface{}{"error": "ERR command timed out"})
+	}
+}
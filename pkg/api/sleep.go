@@ -0,0 +1,183 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Engine is the query engine process behind the handler.
+// Sleep mode stops it when the proxy is idle and starts it again on the next request.
+type Engine interface {
+	Start() error
+	Stop()
+}
+
+// engineReadyTimeout is how long a woken up query engine may take until it serves requests
+var engineReadyTimeout = 60 * time.Second
+
+// wakeup is a start of the query engine by sleep mode, done is closed once it finished
+type wakeup struct {
+	done chan struct{}
+	err  error
+}
+
+// begin marks a request as in flight and stops the idle timer
+func (h *Handler) begin() {
+	h.sleepMu.Lock()
+	defer h.sleepMu.Unlock()
+	h.inFlight++
+	if h.idleTimer != nil {
+		h.idleTimer.Stop()
+		h.idleTimer = nil
+	}
+}
+
+// end marks a request as finished, the idle timer starts once no request is in flight
+func (h *Handler) end() {
+	h.sleepMu.Lock()
+	defer h.sleepMu.Unlock()
+	h.inFlight--
+	h.lastActive = time.Now()
+	if h.inFlight == 0 && !h.asleep {
+		h.idleTimer = time.AfterFunc(h.sleepTimeout(), h.sleep)
+	}
+}
+
+func (h *Handler) sleepTimeout() time.Duration {
+	return time.Duration(h.sleepAfterSeconds) * time.Second
+}
+
+// sleep stops the query engine to free database connections and memory,
+// the HTTP server keeps running.
+// The engines are stopped without holding sleepMu like in wake,
+// a request that starts meanwhile wakes the engine once it was stopped.
+func (h *Handler) sleep() {
+	h.sleepMu.Lock()
+	// a stopped timer may still fire, so the idle time is checked again
+	if h.asleep || h.inFlight > 0 {
+		h.sleepMu.Unlock()
+		return
+	}
+	if idle := time.Since(h.lastActive); idle < h.sleepTimeout() {
+		h.idleTimer = time.AfterFunc(h.sleepTimeout()-idle, h.sleep)
+		h.sleepMu.Unlock()
+		return
+	}
+	if open := h.transactions.count(); open > 0 {
+		// check again once the transactions are committed or expired
+		h.idleTimer = time.AfterFunc(h.sleepTimeout(), h.sleep)
+		h.sleepMu.Unlock()
+		return
+	}
+	h.idleTimer = nil
+	h.asleep = true
+	stopped := make(chan struct{})
+	h.stopping = stopped
+	h.sleepMu.Unlock()
+
+	log.Println("No requests for", h.sleepAfterSeconds, "seconds, stopping query engine")
+	// the clients of previous engines are served by the current engine once it is woken up
+	h.backendMu.Lock()
+	previous := h.previous
+	h.previous = nil
+	h.backendMu.Unlock()
+	for _, b := range previous {
+		b.engine.Stop()
+	}
+	h.current().engine.Stop()
+	close(stopped)
+}
+
+// wake starts the query engine if it was stopped by sleep mode
+// and waits until it is ready to serve requests or ctx is done.
+// Concurrent requests wait for the same start.
+func (h *Handler) wake(ctx context.Context) error {
+	h.sleepMu.Lock()
+	if !h.asleep {
+		h.sleepMu.Unlock()
+		return nil
+	}
+	w := h.waking
+	if w == nil {
+		w = &wakeup{done: make(chan struct{})}
+		h.waking = w
+		go h.startEngine(w, h.stopping)
+	}
+	h.sleepMu.Unlock()
+	select {
+	case <-w.done:
+		return w.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// startEngine starts the query engine of the current backend once sleep closed stopped and waits until it is ready.
+// sleepMu isn't held meanwhile, so requests that don't need the engine and the health endpoint aren't blocked.
+func (h *Handler) startEngine(w *wakeup, stopped chan struct{}) {
+	defer close(w.done)
+	<-stopped
+	log.Println("Waking up query engine")
+	start := time.Now()
+	b := h.current()
+	err := b.engine.Start()
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), engineReadyTimeout)
+		err = h.waitForEngine(ctx, b.url)
+		cancel()
+		if err != nil {
+			b.engine.Stop()
+		}
+	}
+
+	h.sleepMu.Lock()
+	defer h.sleepMu.Unlock()
+	h.waking = nil
+	if err != nil {
+		// the next request tries again
+		w.err = fmt.Errorf("query engine not ready: %w", err)
+		return
+	}
+	if h.current() != b {
+		// SwitchEngine replaced the engine meanwhile
+		b.engine.Stop()
+		return
+	}
+	h.asleep = false
+	elapsed := time.Since(start)
+	logMetric(h.coldStarts.Inc())
+	logMetric(h.coldStartSeconds.Observe(elapsed.Seconds()))
+	log.Printf("Query Engine ready after %s", elapsed)
+	if h.inFlight == 0 && h.idleTimer == nil {
+		// the requests that woke the engine gave up before it was ready
+		h.lastActive = time.Now()
+		h.idleTimer = time.AfterFunc(h.sleepTimeout(), h.sleep)
+	}
+}
+
+func (h *Handler) isAsleep() bool {
+	h.sleepMu.Lock()
+	defer h.sleepMu.Unlock()
+	return h.asleep
+}
+
+// waitForEngine polls the query engine on url until it responds or ctx is done
+func (h *Handler) waitForEngine(ctx context.Context, url string) error {
+	for {
+		resp, err := http.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(3 * time.Millisecond):
+		}
+	}
+}
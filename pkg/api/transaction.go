@@ -0,0 +1,159 @@
+package api
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buger/jsonparser"
+)
+
+// the query engine expires interactive transactions after their timeout,
+// the margin keeps us from forgetting a transaction that is about to commit
+const (
+	defaultTransactionTimeout = 5 * time.Second
+	transactionExpiryMargin   = 5 * time.Second
+)
+
+// transactions keeps track of the interactive transactions that were started
+// through the proxy and not yet committed or rolled back.
+type transactions struct {
+	mu   sync.Mutex
+	open map[string]transaction
+}
+
+// transaction is an open interactive transaction of the query engine behind backend
+type transaction struct {
+	expiresAt time.Time
+	backend   *backend
+}
+
+func newTransactions() *transactions {
+	return &transactions{
+		open: map[string]transaction{},
+	}
+}
+
+func (t *transactions) start(id string, timeout time.Duration, b *backend) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.open[id] = transaction{
+		expiresAt: time.Now().Add(timeout + transactionExpiryMargin),
+		backend:   b,
+	}
+}
+
+func (t *transactions) finish(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.open, id)
+}
+
+func (t *transactions) isOpen(id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.open[id]
+	return ok
+}
+
+// backend returns the backend an open transaction was started on, or nil
+func (t *transactions) backend(id string) *backend {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.open[id].backend
+}
+
+// count returns the number of open transactions, dropping the ones the
+// query engine has already expired
+func (t *transactions) count() int {
+	return t.countOn(nil)
+}
+
+// countOn returns the number of open transactions on b, or on all backends if b is nil
+func (t *transactions) countOn(b *backend) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	count := 0
+	for id, tx := range t.open {
+		if now.After(tx.expiresAt) {
+			delete(t.open, id)
+			continue
+		}
+		if b == nil || tx.backend == b {
+			count++
+		}
+	}
+	return count
+}
+
+// transactionPath returns the query engine path of an interactive transaction request,
+// e.g. /4.16.2/<hash>/transaction/<id>/commit => transaction/<id>/commit
+func transactionPath(path string) (string, bool) {
+	i := strings.Index(path, "/transaction/")
+	if i == -1 {
+		return "", false
+	}
+	return strings.TrimPrefix(path[i:], "/"), true
+}
+
+// transactionID returns the id of the transaction a request belongs to, if any
+func transactionID(r *http.Request) string {
+	if id := r.Header.Get("X-transaction-id"); id != "" {
+		return id
+	}
+	path, ok := transactionPath(r.URL.Path)
+	if !ok {
+		return ""
+	}
+	parts := strings.Split(path, "/")
+	if len(parts) != 3 {
+		return ""
+	}
+	return parts[1]
+}
+
+func (h *Handler) proxyTransaction(b *backend, path string, body []byte, w http.ResponseWriter, r *http.Request) {
+	newRequest, err := http.NewRequestWithContext(r.Context(), r.Method, b.url+path, ioutil.NopCloser(bytes.NewBuffer(body)))
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	newRequest.Header.Set("content-type", "application/json")
+	resp, err := h.client.Do(newRequest)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	switch {
+	case path == "transaction/start":
+		if resp.StatusCode == http.StatusOK {
+			id, _ := jsonparser.GetString(data, "id")
+			timeout := defaultTransactionTimeout
+			if ms, err := jsonparser.GetInt(body, "timeout"); err == nil {
+				timeout = time.Duration(ms) * time.Millisecond
+			}
+			if id != "" {
+				h.transactions.start(id, timeout, b)
+			}
+		}
+	case strings.HasSuffix(path, "/commit"), strings.HasSuffix(path, "/rollback"):
+		h.transactions.finish(transactionID(r))
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(resp.StatusCode)
+	_, _ = w.Write(data)
+}
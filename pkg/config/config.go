@@ -0,0 +1,500 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/caarlos0/env/v6"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds all settings of the proxy. Values are read from the optional
+// config file first and environment variables override them.
+type Config struct {
+	// Data Proxy Wrapper
+	ApiKey            string `env:"API_KEY" yaml:"api_key" envDefault:"SECRET_API_KEY" secret:"true"`
+	Production        bool   `env:"PRODUCTION" yaml:"production" envDefault:"false"`
+	EnableSleepMode   bool   `env:"ENABLE_SLEEP_MODE" yaml:"enable_sleep_mode" envDefault:"false"`
+	SleepAfterSeconds int    `env:"SLEEP_AFTER_SECONDS" yaml:"sleep_after_seconds" envDefault:"10"`
+	ListenAddr        string `env:"LISTEN_ADDR" yaml:"listen_addr" envDefault:"0.0.0.0:4466"`
+	GraphiQLApiURL    string `env:"GRAPHIQL_API_URL" yaml:"graphiql_api_url" envDefault:"http://localhost:4466"`
+	ReadLimitSeconds  int    `env:"READ_LIMIT_SECONDS" yaml:"read_limit_seconds" envDefault:"10000"`
+	WriteLimitSeconds int    `env:"WRITE_LIMIT_SECONDS" yaml:"write_limit_seconds" envDefault:"2000"`
+	HealthEndpoint    string `env:"HEALTH_ENDPOINT" yaml:"health_endpoint" envDefault:"/health"`
+	// enables the /admin endpoints, e.g. to run migrations, if set
+	AdminApiKey     string `env:"ADMIN_API_KEY" yaml:"admin_api_key" envDefault:"" secret:"true"`
+	MetricsEndpoint string `env:"METRICS_ENDPOINT" yaml:"metrics_endpoint" envDefault:"/metrics"`
+	// how long to wait for in-flight requests and open transactions on shutdown
+	DrainTimeoutSeconds int `env:"DRAIN_TIMEOUT_SECONDS" yaml:"drain_timeout_seconds" envDefault:"30"`
+
+	// Prisma
+	PrismaVersion string `env:"PRISMA_VERSION" yaml:"prisma_version" envDefault:"4bc8b6e1b66cb932731fb1bdbbc550d1e010de81"` // 4.4.0-29 @ https://github.com/prisma/engines-wrapper/blob/main/packages/engines-version/package.json
+
+	// Prisma Migration Engine - Schema
+	PrismaSchemaFilePath  string `env:"PRISMA_SCHEMA_FILE" yaml:"prisma_schema_file" envDefault:"./schema.prisma"`
+	EnableMigration       bool   `env:"ENABLE_MIGRATION" yaml:"enable_migration" envDefault:"false"`
+	MigrationLockFilePath string `env:"MIGRATION_LOCK_FILE" yaml:"migration_lock_file" envDefault:"migration.lock"`
+	MigrationEnginePath   string `env:"MIGRATION_ENGINE_PATH" yaml:"migration_engine_path" envDefault:"./migration-engine"`
+	// "push" pushes schema.prisma to the database, "deploy" applies the folders of MIGRATIONS_DIR
+	MigrationMode           string `env:"MIGRATION_MODE" yaml:"migration_mode" envDefault:"push"`
+	MigrationsDir           string `env:"MIGRATIONS_DIR" yaml:"migrations_dir" envDefault:"./prisma/migrations"`
+	MigrationTimeoutSeconds int    `env:"MIGRATION_TIMEOUT_SECONDS" yaml:"migration_timeout_seconds" envDefault:"5"`
+	// apply migrations that drop data instead of refusing them
+	MigrationAllowDataLoss bool `env:"MIGRATION_ALLOW_DATA_LOSS" yaml:"migration_allow_data_loss" envDefault:"false"`
+	// serialize migrations of all replicas with a lock in Redis (REDIS_ADDRESS)
+	MigrationDistributedLock bool   `env:"MIGRATION_DISTRIBUTED_LOCK" yaml:"migration_distributed_lock" envDefault:"false"`
+	MigrationLockKey         string `env:"MIGRATION_LOCK_KEY" yaml:"migration_lock_key" envDefault:"wunderbase:migration"`
+	MigrationLockWaitSeconds int    `env:"MIGRATION_LOCK_WAIT_SECONDS" yaml:"migration_lock_wait_seconds" envDefault:"300"`
+	// what to do if the migration fails: "exit" stops the proxy, "degraded" serves traffic and reports it on the health endpoint
+	MigrationFailurePolicy string `env:"MIGRATION_FAILURE_POLICY" yaml:"migration_failure_policy" envDefault:"exit"`
+	// how often to diff the live database against schema.prisma, 0 disables the drift check
+	SchemaDriftCheckIntervalSeconds int `env:"SCHEMA_DRIFT_CHECK_INTERVAL_SECONDS" yaml:"schema_drift_check_interval_seconds" envDefault:"0"`
+
+	// I think that we should discard `EnablePlayground`, when we add `Production` flag.
+	// EnablePlayground      bool   `env:"ENABLE_PLAYGROUND" envDefault:"true"`
+
+	// Prisma Query Engine - Instance
+	QueryEnginePath     string `env:"QUERY_ENGINE_PATH" yaml:"query_engine_path" envDefault:"./query-engine"`
+	QueryEnginePort     string `env:"QUERY_ENGINE_PORT" yaml:"query_engine_port" envDefault:"4467"`
+	QueryEngineHostBind string `env:"QUERY_ENGINE_HOST_BIND" yaml:"query_engine_host_bind" envDefault:"127.0.0.1"`
+	QueryEngineLog      bool   `env:"QUERY_ENGINE_LOG" yaml:"query_engine_log" envDefault:"false"`
+	EnableRawQueries    bool   `env:"QUERY_ENGINE_RAW_QUERIES" yaml:"query_engine_raw_queries" envDefault:"true"`
+	// Prisma Query Engine - Trace && Metrics
+	EnableMetrics             bool   `env:"ENABLE_METRICS" yaml:"enable_metrics" envDefault:"true"`
+	EnableOpenTelemetry       bool   `env:"ENABLE_OPEN_TELEMETRY" yaml:"enable_open_telemetry" envDefault:"false"`
+	OpenTelemetryEndpoint     string `env:"OPEN_TELEMETRY_ENDPOINT" yaml:"open_telemetry_endpoint" envDefault:""`
+	EnableTelemetryInResponse bool   `env:"ENABLE_TELEMETRY_IN_RESPONSE" yaml:"enable_telemetry_in_response" envDefault:"false"`
+
+	// Prisma Query Engine - Schema Reload
+	// the query engine started by a schema reload runs on this port while the current one is drained,
+	// empty disables the reload unless SchemaWatchIntervalSeconds is set, see StandbyPort
+	QueryEngineStandbyPort string `env:"QUERY_ENGINE_STANDBY_PORT" yaml:"query_engine_standby_port" envDefault:""`
+	// how often to check schema.prisma for changes, 0 disables the reload on change
+	SchemaWatchIntervalSeconds int `env:"SCHEMA_WATCH_INTERVAL_SECONDS" yaml:"schema_watch_interval_seconds" envDefault:"0"`
+	// migrate the database before a reloaded schema is served
+	SchemaReloadMigrate        bool `env:"SCHEMA_RELOAD_MIGRATE" yaml:"schema_reload_migrate" envDefault:"false"`
+	SchemaReloadTimeoutSeconds int  `env:"SCHEMA_RELOAD_TIMEOUT_SECONDS" yaml:"schema_reload_timeout_seconds" envDefault:"60"`
+	// keep the previous query engine for clients of the previous schema until it was idle this long, 0 stops it right away
+	QueryEngineGracePeriodSeconds int `env:"QUERY_ENGINE_GRACE_PERIOD_SECONDS" yaml:"query_engine_grace_period_seconds" envDefault:"0"`
+
+	// Redis Config
+	RedisRestAPIEnable bool `env:"REDIS_REST_API_ENABLE" yaml:"redis_rest_api_enable" envDefault:"false"`
+	// single, sentinel or cluster
+	RedisMode string `env:"REDIS_MODE" yaml:"redis_mode" envDefault:"single"`
+	// the sentinel or cluster node addresses are separated by ","
+	RedisAddress            string `env:"REDIS_ADDRESS" yaml:"redis_address" envDefault:"localhost:6379"`
+	RedisUsername           string `env:"REDIS_USERNAME" yaml:"redis_username" envDefault:""`
+	RedisPassword           string `env:"REDIS_PASSWORD" yaml:"redis_password" envDefault:"" secret:"true"`
+	RedisDB                 int    `env:"REDIS_DB" yaml:"redis_db" envDefault:"0"`
+	RedisSentinelMasterName string `env:"REDIS_SENTINEL_MASTER_NAME" yaml:"redis_sentinel_master_name" envDefault:""`
+	RedisSentinelPassword   string `env:"REDIS_SENTINEL_PASSWORD" yaml:"redis_sentinel_password" envDefault:"" secret:"true"`
+	// 0 is the go-redis default of 10 connections per CPU
+	RedisPoolSize     int  `env:"REDIS_POOL_SIZE" yaml:"redis_pool_size" envDefault:"0"`
+	RedisMinIdleConns int  `env:"REDIS_MIN_IDLE_CONNS" yaml:"redis_min_idle_conns" envDefault:"0"`
+	RedisTLSEnable    bool `env:"REDIS_TLS_ENABLE" yaml:"redis_tls_enable" envDefault:"false"`
+	// verifies the server certificate with this CA instead of the system CAs
+	RedisTLSCAFile string `env:"REDIS_TLS_CA_FILE" yaml:"redis_tls_ca_file" envDefault:""`
+	// client certificate for mutual TLS
+	RedisTLSCertFile           string `env:"REDIS_TLS_CERT_FILE" yaml:"redis_tls_cert_file" envDefault:""`
+	RedisTLSKeyFile            string `env:"REDIS_TLS_KEY_FILE" yaml:"redis_tls_key_file" envDefault:""`
+	RedisTLSInsecureSkipVerify bool   `env:"REDIS_TLS_INSECURE_SKIP_VERIFY" yaml:"redis_tls_insecure_skip_verify" envDefault:"false"`
+	// report the proxy as not ready on the health endpoint while Redis is unreachable
+	RedisHealthCheck bool `env:"REDIS_HEALTH_CHECK" yaml:"redis_health_check" envDefault:"true"`
+	// scopes of API_KEY for the Redis REST API, separated by "|"
+	RedisApiKeyScopes string `env:"REDIS_API_KEY_SCOPES" yaml:"redis_api_key_scopes" envDefault:"read|write|admin"`
+	// additional API keys that may only use the Redis REST API, as key=scope|scope
+	RedisApiKeys []string `env:"REDIS_API_KEYS" yaml:"redis_api_keys" secret:"true"`
+	// if set, only these commands may be run
+	RedisAllowedCommands []string `env:"REDIS_ALLOWED_COMMANDS" yaml:"redis_allowed_commands"`
+	RedisDeniedCommands  []string `env:"REDIS_DENIED_COMMANDS" yaml:"redis_denied_commands"`
+	// max duration of the Redis commands of a REST request
+	RedisCommandTimeoutSeconds int `env:"REDIS_COMMAND_TIMEOUT_SECONDS" yaml:"redis_command_timeout_seconds" envDefault:"10"`
+	// allow blocking commands like BLPOP to wait longer than REDIS_COMMAND_TIMEOUT_SECONDS
+	RedisAllowBlockingCommands bool `env:"REDIS_ALLOW_BLOCKING_COMMANDS" yaml:"redis_allow_blocking_commands" envDefault:"false"`
+	// Redis hash of the named scripts registered with the admin API
+	RedisScriptsKey string `env:"REDIS_SCRIPTS_KEY" yaml:"redis_scripts_key" envDefault:"wunderbase:scripts"`
+	// prefixes of the Redis keys of API_KEY or REDIS_API_KEYS, as key=prefix
+	RedisKeyPrefixes []string `env:"REDIS_KEY_PREFIXES" yaml:"redis_key_prefixes" secret:"true"`
+	// log the Redis REST commands that take at least this long, 0 disables the log
+	RedisSlowCommandThresholdMs int `env:"REDIS_SLOW_COMMAND_THRESHOLD_MS" yaml:"redis_slow_command_threshold_ms" envDefault:"0"`
+}
+
+// redisScopes are the valid scopes of REDIS_API_KEY_SCOPES and REDIS_API_KEYS
+var redisScopes = map[string]bool{"read": true, "write": true, "admin": true}
+
+// RedisAddresses returns the addresses of REDIS_ADDRESS
+func (c *Config) RedisAddresses() []string {
+	var addresses []string
+	for _, address := range strings.Split(c.RedisAddress, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+// StandbyPort returns the port of the query engine started by a schema reload,
+// watching the schema without QUERY_ENGINE_STANDBY_PORT uses the port after QUERY_ENGINE_PORT.
+// It is empty if schema reload is not configured, then the query engine is started without --port in production.
+func (c *Config) StandbyPort() string {
+	if c.QueryEngineStandbyPort != "" || c.SchemaWatchIntervalSeconds <= 0 {
+		return c.QueryEngineStandbyPort
+	}
+	port, err := strconv.Atoi(c.QueryEnginePort)
+	if err != nil {
+		return ""
+	}
+	return strconv.Itoa(port + 1)
+}
+
+// RedisScopes returns the scopes of API_KEY for the Redis REST API
+func (c *Config) RedisScopes() []string {
+	return splitScopes(c.RedisApiKeyScopes)
+}
+
+// RedisKeys returns the scopes of the additional Redis API keys by key
+func (c *Config) RedisKeys() (map[string][]string, error) {
+	keys := map[string][]string{}
+	for _, entry := range c.RedisApiKeys {
+		key, scopes, ok := strings.Cut(entry, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("REDIS_API_KEYS entries must be key=scope|scope, got an entry without a key or \"=\"")
+		}
+		keys[key] = splitScopes(scopes)
+	}
+	return keys, nil
+}
+
+// RedisPrefixes returns the Redis key prefixes by API key
+func (c *Config) RedisPrefixes() (map[string]string, error) {
+	prefixes := map[string]string{}
+	for _, entry := range c.RedisKeyPrefixes {
+		key, prefix, ok := strings.Cut(entry, "=")
+		if !ok || key == "" || prefix == "" {
+			return nil, fmt.Errorf("REDIS_KEY_PREFIXES entries must be key=prefix, got an entry without a key or prefix")
+		}
+		prefixes[key] = prefix
+	}
+	return prefixes, nil
+}
+
+func splitScopes(s string) []string {
+	var scopes []string
+	for _, scope := range strings.Split(s, "|") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			scopes = append(scopes, strings.ToLower(scope))
+		}
+	}
+	return scopes
+}
+
+// Load reads the YAML config file at path, if any, and applies the environment variables on top of it.
+// Settings that are neither in the file nor in the environment keep their defaults.
+// TOML files are not supported and are rejected instead of being parsed as YAML.
+func Load(path string) (*Config, error) {
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		return nil, fmt.Errorf("config file %s: TOML is not supported, use a YAML file", path)
+	}
+	fromEnv := &Config{}
+	err := env.Parse(fromEnv)
+	if err != nil {
+		return nil, fmt.Errorf("parse env: %w", err)
+	}
+	if path == "" {
+		return fromEnv, nil
+	}
+	config := &Config{}
+	// an empty environment only applies the defaults
+	err = env.Parse(config, env.Options{Environment: map[string]string{}})
+	if err != nil {
+		return nil, fmt.Errorf("parse defaults: %w", err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config file: %w", err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err = decoder.Decode(config)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("parse config file %s: %w", path, err)
+	}
+	overrideFromEnv(config, fromEnv)
+	return config, nil
+}
+
+// overrideFromEnv copies every field whose environment variable is set from fromEnv to config
+func overrideFromEnv(config, fromEnv *Config) {
+	dst := reflect.ValueOf(config).Elem()
+	src := reflect.ValueOf(fromEnv).Elem()
+	for i := 0; i < dst.NumField(); i++ {
+		if _, ok := os.LookupEnv(dst.Type().Field(i).Tag.Get("env")); ok {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+}
+
+// ValidationError lists every problem found in a config
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid config:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+// Validate checks the config for values that would only fail at runtime
+// and returns a *ValidationError with all problems found
+func (c *Config) Validate() error {
+	var problems []string
+	addf := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.ApiKey == "" {
+		addf("API_KEY must not be empty")
+	}
+	if c.EnableSleepMode && c.SleepAfterSeconds <= 0 {
+		addf("SLEEP_AFTER_SECONDS must be greater than 0 when sleep mode is enabled, got %d", c.SleepAfterSeconds)
+	}
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		addf("LISTEN_ADDR %q is not a valid host:port address: %s", c.ListenAddr, err)
+	}
+	if c.ReadLimitSeconds <= 0 {
+		addf("READ_LIMIT_SECONDS must be greater than 0, got %d", c.ReadLimitSeconds)
+	}
+	if c.WriteLimitSeconds <= 0 {
+		addf("WRITE_LIMIT_SECONDS must be greater than 0, got %d", c.WriteLimitSeconds)
+	}
+	if !strings.HasPrefix(c.HealthEndpoint, "/") {
+		addf("HEALTH_ENDPOINT must start with /, got %q", c.HealthEndpoint)
+	}
+	if !strings.HasPrefix(c.MetricsEndpoint, "/") {
+		addf("METRICS_ENDPOINT must start with /, got %q", c.MetricsEndpoint)
+	}
+	if c.HealthEndpoint == c.MetricsEndpoint {
+		addf("HEALTH_ENDPOINT and METRICS_ENDPOINT must be different, both are %q", c.HealthEndpoint)
+	}
+	if c.DrainTimeoutSeconds < 0 {
+		addf("DRAIN_TIMEOUT_SECONDS must not be negative, got %d", c.DrainTimeoutSeconds)
+	}
+	if problem := checkFile(c.PrismaSchemaFilePath, false); problem != "" {
+		addf("PRISMA_SCHEMA_FILE %s", problem)
+	}
+	if c.SchemaDriftCheckIntervalSeconds < 0 {
+		addf("SCHEMA_DRIFT_CHECK_INTERVAL_SECONDS must not be negative, got %d", c.SchemaDriftCheckIntervalSeconds)
+	}
+	if c.SchemaWatchIntervalSeconds < 0 {
+		addf("SCHEMA_WATCH_INTERVAL_SECONDS must not be negative, got %d", c.SchemaWatchIntervalSeconds)
+	}
+	if c.SchemaReloadTimeoutSeconds <= 0 {
+		addf("SCHEMA_RELOAD_TIMEOUT_SECONDS must be greater than 0, got %d", c.SchemaReloadTimeoutSeconds)
+	}
+	if c.QueryEngineGracePeriodSeconds < 0 {
+		addf("QUERY_ENGINE_GRACE_PERIOD_SECONDS must not be negative, got %d", c.QueryEngineGracePeriodSeconds)
+	}
+	if standbyPort := c.StandbyPort(); standbyPort != "" {
+		if !isPort(standbyPort) {
+			addf("QUERY_ENGINE_STANDBY_PORT must be a port number between 1 and 65535, got %q", standbyPort)
+		} else if standbyPort == c.QueryEnginePort {
+			addf("QUERY_ENGINE_STANDBY_PORT and QUERY_ENGINE_PORT must be different, both are %q", c.QueryEnginePort)
+		}
+	}
+	if c.AdminApiKey != "" && c.AdminApiKey == c.ApiKey {
+		addf("ADMIN_API_KEY must be different from API_KEY")
+	}
+	// migrations run at startup, through the admin API or before a schema reload
+	if c.EnableMigration || c.AdminApiKey != "" || c.SchemaReloadMigrate {
+		switch c.MigrationMode {
+		case "push":
+		case "deploy":
+			if info, err := os.Stat(c.MigrationsDir); err != nil || !info.IsDir() {
+				addf("MIGRATIONS_DIR %q is not a directory", c.MigrationsDir)
+			}
+		default:
+			addf("MIGRATION_MODE must be \"push\" or \"deploy\", got %q", c.MigrationMode)
+		}
+		if c.MigrationTimeoutSeconds <= 0 {
+			addf("MIGRATION_TIMEOUT_SECONDS must be greater than 0, got %d", c.MigrationTimeoutSeconds)
+		}
+		if c.MigrationDistributedLock {
+			if c.MigrationLockKey == "" {
+				addf("MIGRATION_LOCK_KEY must not be empty when the distributed migration lock is enabled")
+			}
+			if c.MigrationLockWaitSeconds <= 0 {
+				addf("MIGRATION_LOCK_WAIT_SECONDS must be greater than 0, got %d", c.MigrationLockWaitSeconds)
+			}
+		}
+		if c.MigrationFailurePolicy != "exit" && c.MigrationFailurePolicy != "degraded" {
+			addf("MIGRATION_FAILURE_POLICY must be \"exit\" or \"degraded\", got %q", c.MigrationFailurePolicy)
+		}
+	}
+	// the drift detector diffs the database with the migration engine as well
+	if c.EnableMigration || c.AdminApiKey != "" || c.SchemaReloadMigrate || c.SchemaDriftCheckIntervalSeconds > 0 {
+		if problem := checkFile(c.MigrationEnginePath, true); problem != "" {
+			addf("MIGRATION_ENGINE_PATH %s", problem)
+		}
+	}
+	if problem := checkFile(c.QueryEnginePath, true); problem != "" {
+		addf("QUERY_ENGINE_PATH %s", problem)
+	}
+	if !isPort(c.QueryEnginePort) {
+		addf("QUERY_ENGINE_PORT must be a port number between 1 and 65535, got %q", c.QueryEnginePort)
+	}
+	if c.QueryEngineHostBind == "" {
+		addf("QUERY_ENGINE_HOST_BIND must not be empty")
+	}
+	if c.OpenTelemetryEndpoint != "" {
+		if u, err := url.Parse(c.OpenTelemetryEndpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			addf("OPEN_TELEMETRY_ENDPOINT %q is not a valid URL", c.OpenTelemetryEndpoint)
+		}
+	}
+	if c.RedisRestAPIEnable || c.MigrationDistributedLock {
+		if c.RedisAddress == "" {
+			addf("REDIS_ADDRESS must not be empty when the Redis REST API or the distributed migration lock is enabled")
+		}
+		if c.RedisDB < 0 {
+			addf("REDIS_DB must not be negative, got %d", c.RedisDB)
+		}
+		switch c.RedisMode {
+		case "single", "cluster":
+		case "sentinel":
+			if c.RedisSentinelMasterName == "" {
+				addf("REDIS_SENTINEL_MASTER_NAME must not be empty when REDIS_MODE is \"sentinel\"")
+			}
+		default:
+			addf("REDIS_MODE must be \"single\", \"sentinel\" or \"cluster\", got %q", c.RedisMode)
+		}
+		if c.RedisMode == "cluster" && c.RedisDB != 0 {
+			addf("REDIS_DB must be 0 when REDIS_MODE is \"cluster\", got %d", c.RedisDB)
+		}
+		if c.RedisCommandTimeoutSeconds <= 0 {
+			addf("REDIS_COMMAND_TIMEOUT_SECONDS must be greater than 0, got %d", c.RedisCommandTimeoutSeconds)
+		}
+		if c.RedisSlowCommandThresholdMs < 0 {
+			addf("REDIS_SLOW_COMMAND_THRESHOLD_MS must not be negative, got %d", c.RedisSlowCommandThresholdMs)
+		}
+		if c.RedisPoolSize < 0 || c.RedisMinIdleConns < 0 {
+			addf("REDIS_POOL_SIZE and REDIS_MIN_IDLE_CONNS must not be negative")
+		}
+		if c.RedisTLSEnable {
+			for _, file := range []struct{ name, path string }{
+				{"REDIS_TLS_CA_FILE", c.RedisTLSCAFile},
+				{"REDIS_TLS_CERT_FILE", c.RedisTLSCertFile},
+				{"REDIS_TLS_KEY_FILE", c.RedisTLSKeyFile},
+			} {
+				if file.path == "" {
+					continue
+				}
+				if problem := checkFile(file.path, false); problem != "" {
+					addf("%s %s", file.name, problem)
+				}
+			}
+			if (c.RedisTLSCertFile == "") != (c.RedisTLSKeyFile == "") {
+				addf("REDIS_TLS_CERT_FILE and REDIS_TLS_KEY_FILE must be set together")
+			}
+		}
+	}
+	if c.RedisRestAPIEnable {
+		for _, scope := range c.RedisScopes() {
+			if !redisScopes[scope] {
+				addf("REDIS_API_KEY_SCOPES must only contain read, write and admin, got %q", scope)
+			}
+		}
+		keys, err := c.RedisKeys()
+		if err != nil {
+			addf("%s", err)
+		}
+		for key, scopes := range keys {
+			if key == c.ApiKey || key == c.AdminApiKey {
+				addf("REDIS_API_KEYS must not contain API_KEY or ADMIN_API_KEY")
+			}
+			if len(scopes) == 0 {
+				addf("REDIS_API_KEYS entries must have at least one scope")
+			}
+			for _, scope := range scopes {
+				if !redisScopes[scope] {
+					addf("REDIS_API_KEYS scopes must be read, write or admin, got %q", scope)
+				}
+			}
+		}
+		prefixes, err := c.RedisPrefixes()
+		if err != nil {
+			addf("%s", err)
+		}
+		for key := range prefixes {
+			if _, ok := keys[key]; !ok && key != c.ApiKey {
+				addf("REDIS_KEY_PREFIXES must only contain API_KEY or keys of REDIS_API_KEYS")
+			}
+		}
+	}
+
+	if len(problems) != 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// checkFile returns a description of the problem with the file at path, or an empty string
+func checkFile(path string, executable bool) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Sprintf("%q does not exist", path)
+	}
+	if info.IsDir() {
+		return fmt.Sprintf("%q is a directory", path)
+	}
+	if executable && info.Mode()&0111 == 0 {
+		return fmt.Sprintf("%q is not executable", path)
+	}
+	return ""
+}
+
+// isPort reports whether port is a port number between 1 and 65535
+func isPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n <= 65535
+}
+
+// Print writes the effective config as YAML with all secrets redacted
+func (c *Config) Print(w io.Writer) error {
+	redacted := *c
+	v := reflect.ValueOf(&redacted).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if v.Type().Field(i).Tag.Get("secret") != "true" {
+			continue
+		}
+		switch field := v.Field(i); field.Kind() {
+		case reflect.String:
+			if field.String() != "" {
+				field.SetString("<redacted>")
+			}
+		case reflect.Slice:
+			// key=scopes entries keep their scopes
+			entries := make([]string, field.Len())
+			for j := range entries {
+				entries[j] = "<redacted>"
+				if _, scopes, ok := strings.Cut(field.Index(j).String(), "="); ok {
+					entries[j] += "=" + scopes
+				}
+			}
+			field.Set(reflect.ValueOf(entries))
+		}
+	}
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	err := encoder.Encode(&redacted)
+	if err != nil {
+		return err
+	}
+	return encoder.Close()
+}
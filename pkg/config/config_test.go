@@ -0,0 +1,156 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := ioutil.WriteFile(path, []byte("listen_addr: 0.0.0.0:8080\nread_limit_seconds: 50\n"), 0644)
+	require.NoError(t, err)
+	t.Setenv("READ_LIMIT_SECONDS", "100")
+
+	config, err := Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, "0.0.0.0:8080", config.ListenAddr)
+	assert.Equal(t, 100, config.ReadLimitSeconds)
+	assert.Equal(t, 2000, config.WriteLimitSeconds)
+}
+
+func TestLoadUnknownField(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := ioutil.WriteFile(path, []byte("listen_adr: 0.0.0.0:8080\n"), 0644)
+	require.NoError(t, err)
+
+	_, err = Load(path)
+	assert.Error(t, err)
+}
+
+func TestLoadToml(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	err := ioutil.WriteFile(path, []byte("listen_addr = \"0.0.0.0:8080\"\n"), 0644)
+	require.NoError(t, err)
+
+	_, err = Load(path)
+	assert.EqualError(t, err, "config file "+path+": TOML is not supported, use a YAML file")
+}
+
+func TestValidate(t *testing.T) {
+	config, err := Load("")
+	require.NoError(t, err)
+	config.ReadLimitSeconds = 0
+	config.QueryEnginePath = filepath.Join(t.TempDir(), "query-engine")
+	config.QueryEnginePort = "port"
+
+	err = config.Validate()
+	require.Error(t, err)
+	problems := err.(*ValidationError).Problems
+	assert.Contains(t, problems, "READ_LIMIT_SECONDS must be greater than 0, got 0")
+	assert.Contains(t, problems, `QUERY_ENGINE_PORT must be a port number between 1 and 65535, got "port"`)
+	assert.Contains(t, err.Error(), "QUERY_ENGINE_PATH")
+	assert.NotContains(t, err.Error(), "MIGRATION_ENGINE_PATH")
+
+	// the drift detector needs the migration engine without migrations being enabled
+	config.MigrationEnginePath = filepath.Join(t.TempDir(), "migration-engine")
+	config.SchemaDriftCheckIntervalSeconds = 60
+	config.QueryEngineStandbyPort = "standby"
+	problems = config.Validate().(*ValidationError).Problems
+	assert.Contains(t, problems, fmt.Sprintf("MIGRATION_ENGINE_PATH %q does not exist", config.MigrationEnginePath))
+	assert.Contains(t, problems, `QUERY_ENGINE_STANDBY_PORT must be a port number between 1 and 65535, got "standby"`)
+
+	config.QueryEnginePort = "4467"
+	config.QueryEngineStandbyPort = "4467"
+	problems = config.Validate().(*ValidationError).Problems
+	assert.Contains(t, problems, `QUERY_ENGINE_STANDBY_PORT and QUERY_ENGINE_PORT must be different, both are "4467"`)
+}
+
+func TestStandbyPort(t *testing.T) {
+	config, err := Load("")
+	require.NoError(t, err)
+	// without schema reload the query engine keeps being started without --port in production
+	assert.Equal(t, "", config.StandbyPort())
+
+	config.SchemaWatchIntervalSeconds = 5
+	assert.Equal(t, "4467", config.QueryEnginePort)
+	assert.Equal(t, "4468", config.StandbyPort())
+
+	config.QueryEngineStandbyPort = "5000"
+	assert.Equal(t, "5000", config.StandbyPort())
+}
+
+func TestPrint(t *testing.T) {
+	config, err := Load("")
+	require.NoError(t, err)
+	config.RedisPassword = "hunter2"
+	config.RedisApiKeys = []string{"reader-key=read"}
+
+	out := &bytes.Buffer{}
+	require.NoError(t, config.Print(out))
+	assert.Contains(t, out.String(), "api_key: <redacted>")
+	assert.Contains(t, out.String(), "redis_password: <redacted>")
+	assert.NotContains(t, out.String(), "SECRET_API_KEY")
+	assert.NotContains(t, out.String(), "hunter2")
+	assert.Contains(t, out.String(), "<redacted>=read")
+	assert.NotContains(t, out.String(), "reader-key")
+}
+
+func TestRedisKeys(t *testing.T) {
+	t.Setenv("REDIS_API_KEYS", "reader=read,writer=read|write")
+	config, err := Load("")
+	require.NoError(t, err)
+	// API_KEY keeps running every command after an upgrade
+	assert.Equal(t, []string{"read", "write", "admin"}, config.RedisScopes())
+	keys, err := config.RedisKeys()
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{"reader": {"read"}, "writer": {"read", "write"}}, keys)
+
+	config.RedisRestAPIEnable = true
+	config.RedisApiKeyScopes = "read|all"
+	config.RedisApiKeys = []string{"SECRET_API_KEY=read", "other=delete"}
+	config.RedisKeyPrefixes = []string{"unknown=app:", "other="}
+	err = config.Validate()
+	require.Error(t, err)
+	problems := err.(*ValidationError).Problems
+	assert.Contains(t, problems, `REDIS_API_KEY_SCOPES must only contain read, write and admin, got "all"`)
+	assert.Contains(t, problems, "REDIS_API_KEYS must not contain API_KEY or ADMIN_API_KEY")
+	assert.Contains(t, problems, `REDIS_API_KEYS scopes must be read, write or admin, got "delete"`)
+	assert.Contains(t, problems, "REDIS_KEY_PREFIXES entries must be key=prefix, got an entry without a key or prefix")
+
+	config.RedisKeyPrefixes = []string{"unknown=app:", "other=other:"}
+	prefixes, err := config.RedisPrefixes()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"unknown": "app:", "other": "other:"}, prefixes)
+	problems = config.Validate().(*ValidationError).Problems
+	assert.Contains(t, problems, "REDIS_KEY_PREFIXES must only contain API_KEY or keys of REDIS_API_KEYS")
+}
+
+func TestValidateRedis(t *testing.T) {
+	config, err := Load("")
+	require.NoError(t, err)
+	config.RedisRestAPIEnable = true
+	config.RedisMode = "sentinel"
+	config.RedisTLSEnable = true
+	config.RedisTLSCertFile = filepath.Join(t.TempDir(), "client.crt")
+	err = config.Validate()
+	require.Error(t, err)
+	problems := err.(*ValidationError).Problems
+	assert.Contains(t, problems, `REDIS_SENTINEL_MASTER_NAME must not be empty when REDIS_MODE is "sentinel"`)
+	assert.Contains(t, problems, "REDIS_TLS_CERT_FILE and REDIS_TLS_KEY_FILE must be set together")
+	assert.Contains(t, err.Error(), "REDIS_TLS_CERT_FILE")
+
+	config.RedisMode = "replicated"
+	config.RedisSlowCommandThresholdMs = -1
+	problems = config.Validate().(*ValidationError).Problems
+	assert.Contains(t, problems, `REDIS_MODE must be "single", "sentinel" or "cluster", got "replicated"`)
+	assert.Contains(t, problems, "REDIS_SLOW_COMMAND_THRESHOLD_MS must not be negative, got -1")
+
+	config.RedisAddress = "node-1:6379, node-2:6379,"
+	assert.Equal(t, []string{"node-1:6379", "node-2:6379"}, config.RedisAddresses())
+}
@@ -0,0 +1,43 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	counter := r.Counter("requests_total", "Requests.", "method")
+	gauge := r.Gauge("up", "Up.")
+	histogram := r.Histogram("duration_seconds", "Duration.", []float64{1}, "method")
+
+	require.NoError(t, counter.Inc("GET"))
+	require.NoError(t, gauge.Set(1))
+	require.NoError(t, histogram.Observe(0.5, "GET"))
+
+	out := &strings.Builder{}
+	r.WritePrometheus(out)
+	assert.Contains(t, out.String(), `requests_total{method="GET"} 1`)
+	assert.Contains(t, out.String(), "up 1")
+	assert.Contains(t, out.String(), `duration_seconds_bucket{method="GET",le="1"} 1`)
+	assert.Contains(t, out.String(), `duration_seconds_count{method="GET"} 1`)
+}
+
+func TestLabelMismatch(t *testing.T) {
+	r := NewRegistry()
+	counter := r.Counter("requests_total", "Requests.", "method")
+	histogram := r.Histogram("duration_seconds", "Duration.", nil, "method")
+
+	// a wrong number of label values is reported instead of crashing the proxy
+	assert.EqualError(t, counter.Inc(), "metric requests_total expects 1 label values, got 0")
+	assert.Error(t, counter.Add(1, "GET", "extra"))
+	assert.Error(t, histogram.Observe(1))
+
+	out := &strings.Builder{}
+	r.WritePrometheus(out)
+	assert.NotContains(t, out.String(), "requests_total 1")
+	assert.NotContains(t, out.String(), "duration_seconds_count")
+}
@@ -0,0 +1,137 @@
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// ApplyResult reports which migrations of the migrations directory ran
+type ApplyResult struct {
+	Applied        []string `json:"applied"`
+	AlreadyApplied []string `json:"alreadyApplied"`
+	// Failed is the migration that failed, the migrations after it were not applied
+	Failed string `json:"failed,omitempty"`
+}
+
+type applyMigrationsParams struct {
+	MigrationsDirectoryPath string `json:"migrationsDirectoryPath"`
+}
+
+type applyMigrationsResult struct {
+	AppliedMigrationNames []string `json:"appliedMigrationNames"`
+}
+
+// ApplyMigrations applies the pending migrations of options.MigrationsDir, e.g. prisma/migrations/*/migration.sql.
+// The migration engine records them in the _prisma_migrations table, so applied migrations are skipped.
+// If a migration fails, the result names it together with the returned error.
+func ApplyMigrations(ctx context.Context, options Options) (*ApplyResult, error) {
+	local, err := migrationNames(options.MigrationsDir)
+	if err != nil {
+		return nil, err
+	}
+	result := &ApplyResult{
+		Applied:        []string{},
+		AlreadyApplied: []string{},
+	}
+	var applied []string
+	err = withClient(ctx, options, func(ctx context.Context, client *Client) error {
+		applied, err = client.ApplyMigrations(ctx, options.MigrationsDir)
+		return err
+	})
+	if err != nil {
+		var engineErr *MigrationResponseError
+		if errors.As(err, &engineErr) {
+			result.Failed = engineErr.Data.Meta.MigrationName
+		}
+		return result, err
+	}
+	result.Applied = append(result.Applied, applied...)
+	ran := map[string]bool{}
+	for _, name := range applied {
+		ran[name] = true
+	}
+	for _, name := range local {
+		if !ran[name] {
+			result.AlreadyApplied = append(result.AlreadyApplied, name)
+		}
+	}
+	return result, nil
+}
+
+// DeployDryRun reports the pending migrations of options.MigrationsDir and their steps
+// without applying them
+func DeployDryRun(ctx context.Context, options Options) (*DiffReport, error) {
+	var history *MigrationHistoryResult
+	err := withClient(ctx, options, func(ctx context.Context, client *Client) error {
+		var err error
+		history, err = client.DiagnoseMigrationHistory(ctx, options.MigrationsDir)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(history.FailedMigrationNames) != 0 {
+		// deploy refuses to run until they are resolved
+		return nil, fmt.Errorf("failed migrations must be resolved first: %v", history.FailedMigrationNames)
+	}
+	var pending []string
+	if history.History != nil && history.History.Diagnostic == "databaseIsBehind" {
+		pending = history.History.UnappliedMigrationNames
+	}
+	script := ""
+	for _, name := range pending {
+		data, err := ioutil.ReadFile(filepath.Join(options.MigrationsDir, name, "migration.sql"))
+		if err != nil {
+			return nil, err
+		}
+		script += string(data) + "\n"
+	}
+	report := parseDiffScript(script)
+	report.Pending = pending
+	return report, nil
+}
+
+// MigrationsHash returns the hash of the names and SQL of the migrations in dir,
+// it changes with every added migration, even if schema.prisma stays the same
+func MigrationsHash(dir string) (string, error) {
+	names, err := migrationNames(dir)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	for _, name := range names {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name, "migration.sql"))
+		if err != nil {
+			return "", err
+		}
+		_, _ = fmt.Fprintf(hash, "%s\n%d\n", name, len(data))
+		_, _ = hash.Write(data)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// migrationNames returns the sorted names of the migration folders in dir
+func migrationNames(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, entry.Name(), "migration.sql")); err == nil {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,415 @@
+package migrate
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrClosed is returned for requests to a client whose migration engine has exited
+var ErrClosed = errors.New("migration engine exited")
+
+// LogLine is a log line the migration engine wrote to stderr
+type LogLine struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level,omitempty"`
+	Message string    `json:"message"`
+}
+
+// Client talks JSON-RPC to a long running migration engine process.
+// Requests may be sent concurrently, responses are correlated by their id.
+type Client struct {
+	cmd    *exec.Cmd
+	in     io.WriteCloser
+	exited chan struct{}
+
+	writeMu sync.Mutex
+
+	mu          sync.Mutex
+	nextID      int
+	pending     map[int]chan *MigrationResponse
+	logHandlers map[int]func(LogLine)
+	nextHandler int
+	print       func(content string)
+	err         error
+
+	// the diff script is sent in print requests, which can't be correlated to a diff request
+	diffMu sync.Mutex
+
+	// OnNotification is called for notifications of the engine, it must be set before the first request
+	OnNotification func(method string, params json.RawMessage)
+}
+
+// NewClient starts the migration engine for options.SchemaPath
+func NewClient(options Options) (*Client, error) {
+	cmd := exec.Command(options.MigrationEnginePath, "--datamodel", options.SchemaPath)
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("migration engine stdin pipe: %w", err)
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("migration engine stdout pipe: %w", err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, fmt.Errorf("migration engine stderr pipe: %w", err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("start migration engine: %w", err)
+	}
+	c := &Client{
+		cmd:         cmd,
+		in:          in,
+		exited:      make(chan struct{}),
+		nextID:      1,
+		pending:     map[int]chan *MigrationResponse{},
+		logHandlers: map[int]func(LogLine){},
+	}
+	if options.OnLog != nil {
+		c.AddLogHandler(options.OnLog)
+	}
+	logsDone := make(chan struct{})
+	go func() {
+		c.readLogs(stderr)
+		close(logsDone)
+	}()
+	go func() {
+		c.readMessages(out)
+		<-logsDone
+		err := cmd.Wait()
+		c.mu.Lock()
+		c.err = ErrClosed
+		if err != nil {
+			c.err = fmt.Errorf("%w: %s", ErrClosed, err)
+		}
+		for id, ch := range c.pending {
+			close(ch)
+			delete(c.pending, id)
+		}
+		c.mu.Unlock()
+		close(c.exited)
+	}()
+	return c, nil
+}
+
+// Close stops the migration engine, it is killed if it doesn't exit after stdin was closed
+func (c *Client) Close() error {
+	_ = c.in.Close()
+	select {
+	case <-c.exited:
+	case <-time.After(time.Second):
+		_ = c.cmd.Process.Kill()
+		<-c.exited
+	}
+	return nil
+}
+
+// AddLogHandler registers handler for the log lines of the engine, remove unregisters it
+func (c *Client) AddLogHandler(handler func(LogLine)) (remove func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id := c.nextHandler
+	c.nextHandler++
+	c.logHandlers[id] = handler
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.logHandlers, id)
+	}
+}
+
+// Call sends a JSON-RPC request and decodes the result into result, which may be nil.
+// Errors of the engine are returned as *MigrationResponseError.
+func (c *Client) Call(ctx context.Context, method string, params, result interface{}) error {
+	c.mu.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		return err
+	}
+	id := c.nextID
+	c.nextID++
+	ch := make(chan *MigrationResponse, 1)
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	err := c.write(MigrationRequest{
+		Id:      id,
+		Jsonrpc: "2.0",
+		Method:  method,
+		Params:  params,
+	})
+	if err != nil {
+		c.forget(id)
+		return fmt.Errorf("write migration request: %w", err)
+	}
+
+	select {
+	case <-ctx.Done():
+		c.forget(id)
+		if ctx.Err() == context.DeadlineExceeded {
+			return ErrTimeout
+		}
+		return ctx.Err()
+	case resp, ok := <-ch:
+		if !ok {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return c.err
+		}
+		if resp.Error != nil {
+			return resp.Error
+		}
+		if result == nil {
+			return nil
+		}
+		err = json.Unmarshal(resp.Result, result)
+		if err != nil {
+			return fmt.Errorf("unmarshal migration result: %w", err)
+		}
+		return nil
+	}
+}
+
+// SchemaPush pushes schema to the database without a migration history.
+// Without force, changes with warnings are not applied.
+func (c *Client) SchemaPush(ctx context.Context, schema string, force bool) (*MigrationResponseResult, error) {
+	var result MigrationResponseResult
+	err := c.Call(ctx, "schemaPush", MigrationRequestParams{
+		Force:  force,
+		Schema: schema,
+	}, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// DiffResult is the result of the diff method
+type DiffResult struct {
+	ExitCode int `json:"exitCode"`
+	// Script is the SQL script the engine printed, if requested
+	Script string `json:"-"`
+}
+
+// Diff compares two schemas, e.g. the live database with the datamodel
+func (c *Client) Diff(ctx context.Context, params DiffParams) (*DiffResult, error) {
+	c.diffMu.Lock()
+	defer c.diffMu.Unlock()
+	script := &strings.Builder{}
+	c.mu.Lock()
+	c.print = func(content string) {
+		script.WriteString(content)
+	}
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.print = nil
+		c.mu.Unlock()
+	}()
+	var result DiffResult
+	err := c.Call(ctx, "diff", params, &result)
+	if err != nil {
+		return nil, err
+	}
+	// print requests are handled before the response is dispatched
+	result.Script = script.String()
+	return &result, nil
+}
+
+// DevDiagnosticResult is the result of the devDiagnostic method,
+// Action.Tag is "createMigration" or "reset"
+type DevDiagnosticResult struct {
+	Action struct {
+		Tag    string `json:"tag"`
+		Reason string `json:"reason,omitempty"`
+	} `json:"action"`
+}
+
+// DevDiagnostic checks whether the migrations directory and the database are in sync
+func (c *Client) DevDiagnostic(ctx context.Context, migrationsDir string) (*DevDiagnosticResult, error) {
+	var result DevDiagnosticResult
+	err := c.Call(ctx, "devDiagnostic", applyMigrationsParams{
+		MigrationsDirectoryPath: migrationsDir,
+	}, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// ApplyMigrations applies the pending migrations of migrationsDir and returns their names
+func (c *Client) ApplyMigrations(ctx context.Context, migrationsDir string) ([]string, error) {
+	var result applyMigrationsResult
+	err := c.Call(ctx, "applyMigrations", applyMigrationsParams{
+		MigrationsDirectoryPath: migrationsDir,
+	}, &result)
+	if err != nil {
+		return nil, err
+	}
+	return result.AppliedMigrationNames, nil
+}
+
+type diagnoseMigrationHistoryParams struct {
+	MigrationsDirectoryPath string `json:"migrationsDirectoryPath"`
+	OptInToShadowDatabase   bool   `json:"optInToShadowDatabase"`
+}
+
+// MigrationHistoryResult is the result of the diagnoseMigrationHistory method,
+// History.Diagnostic is e.g. "databaseIsBehind" if migrations of the directory were not applied yet
+type MigrationHistoryResult struct {
+	History *struct {
+		Diagnostic              string   `json:"diagnostic"`
+		UnappliedMigrationNames []string `json:"unappliedMigrationNames"`
+	} `json:"history"`
+	FailedMigrationNames []string `json:"failedMigrationNames"`
+	EditedMigrationNames []string `json:"editedMigrationNames"`
+}
+
+// DiagnoseMigrationHistory compares migrationsDir with the migrations recorded in the database,
+// without a shadow database like migrate deploy
+func (c *Client) DiagnoseMigrationHistory(ctx context.Context, migrationsDir string) (*MigrationHistoryResult, error) {
+	var result MigrationHistoryResult
+	err := c.Call(ctx, "diagnoseMigrationHistory", diagnoseMigrationHistoryParams{
+		MigrationsDirectoryPath: migrationsDir,
+	}, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetDatabaseVersion returns the version string of the database server
+func (c *Client) GetDatabaseVersion(ctx context.Context) (string, error) {
+	var version string
+	err := c.Call(ctx, "getDatabaseVersion", nil, &version)
+	if err != nil {
+		return "", err
+	}
+	return version, nil
+}
+
+func (c *Client) forget(id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, id)
+}
+
+func (c *Client) write(message interface{}) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return writeMessage(c.in, message)
+}
+
+// readMessages dispatches responses, requests and notifications of the engine until stdout is closed
+func (c *Client) readMessages(out io.Reader) {
+	reader := bufio.NewReader(out)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(strings.TrimSpace(string(line))) != 0 {
+			c.handleMessage(line)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *Client) handleMessage(line []byte) {
+	var message MigrationResponse
+	err := json.Unmarshal(line, &message)
+	if err != nil {
+		log.Printf("migration engine: unexpected output %q", strings.TrimSpace(string(line)))
+		return
+	}
+	switch {
+	case message.Method == "print":
+		var params struct {
+			Content string `json:"content"`
+		}
+		_ = json.Unmarshal(message.Params, &params)
+		c.mu.Lock()
+		print := c.print
+		c.mu.Unlock()
+		if print != nil {
+			print(params.Content)
+		}
+		err = c.write(map[string]interface{}{"jsonrpc": "2.0", "id": message.Id, "result": nil})
+		if err != nil {
+			log.Println("answer migration engine", err)
+		}
+	case message.Method != "" && message.Id != nil:
+		err = c.write(map[string]interface{}{
+			"jsonrpc": "2.0",
+			"id":      message.Id,
+			"error":   map[string]interface{}{"code": -32601, "message": "Method not found"},
+		})
+		if err != nil {
+			log.Println("answer migration engine", err)
+		}
+	case message.Method != "":
+		if c.OnNotification != nil {
+			c.OnNotification(message.Method, message.Params)
+		}
+	default:
+		var id int
+		err = json.Unmarshal(message.Id, &id)
+		if err != nil {
+			log.Printf("migration engine: response with unexpected id %s", string(message.Id))
+			return
+		}
+		c.mu.Lock()
+		ch, ok := c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+		if ok {
+			ch <- &message
+		}
+	}
+}
+
+// readLogs passes the log lines of the engine to the log handlers until stderr is closed.
+// The engine logs JSON, e.g. {"timestamp":"…","level":"INFO","fields":{"message":"…"},"target":"…"}
+func (c *Client) readLogs(stderr io.Reader) {
+	scanner := bufio.NewScanner(stderr)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		line := LogLine{Time: time.Now().UTC(), Message: text}
+		var structured struct {
+			Level  string `json:"level"`
+			Fields struct {
+				Message string `json:"message"`
+			} `json:"fields"`
+		}
+		if json.Unmarshal([]byte(text), &structured) == nil && structured.Fields.Message != "" {
+			line.Level = structured.Level
+			line.Message = structured.Fields.Message
+		}
+		c.mu.Lock()
+		handlers := make([]func(LogLine), 0, len(c.logHandlers))
+		for _, handler := range c.logHandlers {
+			handlers = append(handlers, handler)
+		}
+		c.mu.Unlock()
+		if len(handlers) == 0 {
+			log.Printf("migration engine: %s %s", line.Level, line.Message)
+		}
+		for _, handler := range handlers {
+			handler(line)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package migrate
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// the test binary acts as fake migration engine if FAKE_MIGRATION_ENGINE is set
+func TestMain(m *testing.M) {
+	if os.Getenv("FAKE_MIGRATION_ENGINE") == "1" {
+		runFakeEngine()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runFakeEngine answers each request in its own goroutine with the method name as result,
+// "slow" requests are answered after the ones sent later
+func runFakeEngine() {
+	mu := &sync.Mutex{}
+	send := func(message map[string]interface{}) {
+		data, _ := json.Marshal(message)
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Println(string(data))
+	}
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		var req MigrationRequest
+		if json.Unmarshal(scanner.Bytes(), &req) != nil || req.Method == "" {
+			continue
+		}
+		fmt.Fprintf(os.Stderr, `{"timestamp":"2022-10-01T00:00:00Z","level":"INFO","fields":{"message":"handling %s"},"target":"migration_engine"}`+"\n", req.Method)
+		switch req.Method {
+		case "exit":
+			os.Exit(1)
+		case "notify":
+			send(map[string]interface{}{"jsonrpc": "2.0", "method": "progress", "params": map[string]interface{}{"step": 1}})
+		case "diff":
+			send(map[string]interface{}{"jsonrpc": "2.0", "id": 100, "method": "print", "params": map[string]interface{}{"content": "-- CreateTable\n"}})
+		}
+		go func(req MigrationRequest) {
+			if req.Method == "slow" {
+				time.Sleep(100 * time.Millisecond)
+			}
+			if req.Method == "getDatabaseVersion" {
+				send(map[string]interface{}{"jsonrpc": "2.0", "id": req.Id, "result": "PostgreSQL 15.0"})
+				return
+			}
+			send(map[string]interface{}{"jsonrpc": "2.0", "id": req.Id, "result": map[string]interface{}{"method": req.Method, "exitCode": 2}})
+		}(req)
+	}
+}
+
+func newFakeClient(t *testing.T) *Client {
+	t.Setenv("FAKE_MIGRATION_ENGINE", "1")
+	client, err := NewClient(Options{MigrationEnginePath: os.Args[0], SchemaPath: "schema.prisma"})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+	return client
+}
+
+func TestClientConcurrentRequests(t *testing.T) {
+	client := newFakeClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	methods := []string{"slow", "schemaPush", "devDiagnostic", "applyMigrations"}
+	wg := &sync.WaitGroup{}
+	for _, method := range methods {
+		wg.Add(1)
+		go func(method string) {
+			defer wg.Done()
+			var result struct {
+				Method string `json:"method"`
+			}
+			err := client.Call(ctx, method, nil, &result)
+			assert.NoError(t, err)
+			assert.Equal(t, method, result.Method)
+		}(method)
+	}
+	wg.Wait()
+
+	version, err := client.GetDatabaseVersion(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "PostgreSQL 15.0", version)
+}
+
+func TestClientNotificationsAndLogs(t *testing.T) {
+	client := newFakeClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	notifications := make(chan string, 1)
+	client.OnNotification = func(method string, params json.RawMessage) {
+		notifications <- method
+	}
+	logs := make(chan LogLine, 10)
+	remove := client.AddLogHandler(func(line LogLine) {
+		logs <- line
+	})
+	defer remove()
+
+	require.NoError(t, client.Call(ctx, "notify", nil, nil))
+	assert.Equal(t, "progress", <-notifications)
+	line := <-logs
+	assert.Equal(t, "INFO", line.Level)
+	assert.Equal(t, "handling notify", line.Message)
+
+	result, err := client.Diff(ctx, DiffParams{})
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.ExitCode)
+	assert.Equal(t, "-- CreateTable\n", result.Script)
+}
+
+func TestClientEngineExit(t *testing.T) {
+	client := newFakeClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := client.Call(ctx, "exit", nil, nil)
+	assert.ErrorIs(t, err, ErrClosed)
+	err = client.Call(ctx, "schemaPush", nil, nil)
+	assert.ErrorIs(t, err, ErrClosed)
+}
@@ -0,0 +1,117 @@
+package migrate
+
+import (
+	"context"
+	"strings"
+)
+
+// DiffReport describes what a migration would change in the database
+type DiffReport struct {
+	SchemaHash string `json:"schemaHash"`
+	// Empty is true if the database already matches the schema
+	Empty    bool       `json:"empty"`
+	Steps    []DiffStep `json:"steps"`
+	Warnings []string   `json:"warnings"`
+	// Destructive is true if applying the diff loses data or may fail on existing data
+	Destructive bool `json:"destructive"`
+	// Script is the SQL script generated by the migration engine
+	Script string `json:"script"`
+	// Pending are the migrations of the migrations directory that deploy mode would apply
+	Pending []string `json:"pending,omitempty"`
+}
+
+// DiffStep is a single change of a diff, e.g. {"kind":"AlterTable","sql":"ALTER TABLE ..."}
+type DiffStep struct {
+	Kind string `json:"kind"`
+	SQL  string `json:"sql"`
+}
+
+// DiffTarget is one side of a diff, e.g. {"tag":"schemaDatasource","schema":"./schema.prisma"} for the live database
+type DiffTarget struct {
+	Tag    string `json:"tag"`
+	Schema string `json:"schema,omitempty"`
+}
+
+// DiffParams are the params of the diff method
+type DiffParams struct {
+	From              DiffTarget `json:"from"`
+	To                DiffTarget `json:"to"`
+	Script            bool       `json:"script"`
+	ShadowDatabaseUrl *string    `json:"shadowDatabaseUrl"`
+	ExitCode          *bool      `json:"exitCode"`
+}
+
+// DryRun asks the migration engine for the difference between the live database
+// and the schema without changing the database
+func DryRun(ctx context.Context, options Options, schema string) (*DiffReport, error) {
+	var result *DiffResult
+	err := withClient(ctx, options, func(ctx context.Context, client *Client) error {
+		var err error
+		result, err = client.Diff(ctx, DiffParams{
+			From: DiffTarget{
+				Tag:    "schemaDatasource",
+				Schema: options.SchemaPath,
+			},
+			To: DiffTarget{
+				Tag:    "schemaDatamodel",
+				Schema: options.SchemaPath,
+			},
+			Script: true,
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	report := parseDiffScript(result.Script)
+	report.SchemaHash = SchemaHash(schema)
+	return report, nil
+}
+
+// parseDiffScript parses the SQL script of the migration engine, which looks like
+//
+//	/*
+//	  Warnings:
+//
+//	  - You are about to drop the column `name` on the `User` table. All the data in the column will be lost.
+//
+//	*/
+//	-- AlterTable
+//	ALTER TABLE "User" DROP COLUMN "name";
+func parseDiffScript(script string) *DiffReport {
+	report := &DiffReport{
+		Script:   script,
+		Steps:    []DiffStep{},
+		Warnings: []string{},
+	}
+	inComment := false
+	var step *DiffStep
+	for _, line := range strings.Split(script, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, "/*"):
+			inComment = true
+		case inComment:
+			if strings.HasPrefix(trimmed, "*/") {
+				inComment = false
+			} else if strings.HasPrefix(trimmed, "- ") {
+				report.Warnings = append(report.Warnings, strings.TrimPrefix(trimmed, "- "))
+			}
+		case strings.HasPrefix(trimmed, "-- "):
+			kind := strings.TrimPrefix(trimmed, "-- ")
+			if kind == "This is an empty migration." {
+				continue
+			}
+			report.Steps = append(report.Steps, DiffStep{Kind: kind})
+			step = &report.Steps[len(report.Steps)-1]
+		case trimmed != "" && step != nil:
+			if step.SQL != "" {
+				step.SQL += "\n"
+			}
+			step.SQL += trimmed
+		}
+	}
+	report.Empty = len(report.Steps) == 0
+	report.Destructive = len(report.Warnings) != 0
+	return report
+}
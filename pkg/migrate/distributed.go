@@ -0,0 +1,145 @@
+package migrate
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Locker makes sure only one replica migrates the database at a time
+type Locker interface {
+	// Lock blocks until the lock is acquired or ctx is done
+	Lock(ctx context.Context) (unlock func(), err error)
+	// Completed returns the hash of the last successful migration, or an empty string
+	Completed(ctx context.Context) (string, error)
+	// Complete records the hash of a successful migration, the schema hash or in deploy mode the MigrationsHash
+	Complete(ctx context.Context, schemaHash string) error
+}
+
+// Coordinate runs migrate while holding the lock of locker, unless a replica already migrated schemaHash.
+// Replicas waiting for the lock verify the schema hash recorded by the replica that migrated before them,
+// and only migrate themselves if it differs from schemaHash.
+func Coordinate(ctx context.Context, locker Locker, schemaHash string, migrate func() error) (skipped bool, err error) {
+	completed, err := locker.Completed(ctx)
+	if err != nil {
+		return false, fmt.Errorf("read completed migration: %w", err)
+	}
+	if completed == schemaHash {
+		log.Println("Migration already executed by another replica, skipping")
+		return true, nil
+	}
+	log.Println("Waiting for migration lock")
+	unlock, err := locker.Lock(ctx)
+	if err != nil {
+		return false, fmt.Errorf("acquire migration lock: %w", err)
+	}
+	defer unlock()
+	completed, err = locker.Completed(ctx)
+	if err != nil {
+		return false, fmt.Errorf("read completed migration: %w", err)
+	}
+	if completed == schemaHash {
+		log.Println("Migration executed by another replica while waiting, schema hash verified")
+		return true, nil
+	}
+	if completed != "" {
+		log.Printf("Last migration was for schema %s, migrating to %s", completed, schemaHash)
+	}
+	err = migrate()
+	if err != nil {
+		return false, err
+	}
+	err = locker.Complete(ctx, schemaHash)
+	if err != nil {
+		return false, fmt.Errorf("record completed migration: %w", err)
+	}
+	return false, nil
+}
+
+// the lock is only released if it still holds our token
+var (
+	unlockScript = redis.NewScript(`if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`)
+	extendScript = redis.NewScript(`if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) else return 0 end`)
+)
+
+// RedisLocker is a Locker shared by all replicas using the same Redis.
+// The lock expires after ttl if the replica holding it dies, it is extended while held.
+type RedisLocker struct {
+	client       redis.Cmdable
+	key          string
+	ttl          time.Duration
+	pollInterval time.Duration
+}
+
+func NewRedisLocker(client redis.Cmdable, key string, ttl time.Duration) *RedisLocker {
+	return &RedisLocker{
+		client:       client,
+		key:          key,
+		ttl:          ttl,
+		pollInterval: 500 * time.Millisecond,
+	}
+}
+
+func (l *RedisLocker) Lock(ctx context.Context) (func(), error) {
+	token := make([]byte, 16)
+	_, err := rand.Read(token)
+	if err != nil {
+		return nil, err
+	}
+	value := hex.EncodeToString(token)
+	for {
+		ok, err := l.client.SetNX(ctx, l.key, value, l.ttl).Result()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(l.pollInterval):
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(l.ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				err := extendScript.Run(context.Background(), l.client, []string{l.key}, value, l.ttl.Milliseconds()).Err()
+				if err != nil {
+					log.Println("extend migration lock", err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		err := unlockScript.Run(context.Background(), l.client, []string{l.key}, value).Err()
+		if err != nil {
+			log.Println("release migration lock", err)
+		}
+	}, nil
+}
+
+func (l *RedisLocker) Completed(ctx context.Context) (string, error) {
+	hash, err := l.client.Get(ctx, l.key+":completed").Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return hash, err
+}
+
+func (l *RedisLocker) Complete(ctx context.Context, schemaHash string) error {
+	return l.client.Set(ctx, l.key+":completed", schemaHash, 0).Err()
+}
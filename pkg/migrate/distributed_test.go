@@ -0,0 +1,108 @@
+package migrate
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type memoryLocker struct {
+	mu        sync.Mutex
+	completed string
+	lock      chan struct{}
+}
+
+func (l *memoryLocker) Lock(ctx context.Context) (func(), error) {
+	select {
+	case l.lock <- struct{}{}:
+		return func() { <-l.lock }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *memoryLocker) Completed(ctx context.Context) (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.completed, nil
+}
+
+func (l *memoryLocker) Complete(ctx context.Context, schemaHash string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.completed = schemaHash
+	return nil
+}
+
+func TestCoordinate(t *testing.T) {
+	locker := &memoryLocker{lock: make(chan struct{}, 1)}
+	var migrations int32
+	migrate := func() error {
+		atomic.AddInt32(&migrations, 1)
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	}
+
+	wg := &sync.WaitGroup{}
+	var skipped int32
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := Coordinate(context.Background(), locker, SchemaHash("model User {}"), migrate)
+			assert.NoError(t, err)
+			if ok {
+				atomic.AddInt32(&skipped, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), migrations)
+	assert.Equal(t, int32(2), skipped)
+
+	// a new schema is migrated again
+	ok, err := Coordinate(context.Background(), locker, SchemaHash("model Post {}"), migrate)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, int32(2), migrations)
+}
+
+func TestRunnerDeployNewMigration(t *testing.T) {
+	dir := t.TempDir()
+	schemaPath := filepath.Join(dir, "schema.prisma")
+	require.NoError(t, ioutil.WriteFile(schemaPath, []byte("model User {}"), 0644))
+	migrationsDir := filepath.Join(dir, "migrations")
+	addMigration := func(name string) {
+		require.NoError(t, os.MkdirAll(filepath.Join(migrationsDir, name), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(migrationsDir, name, "migration.sql"), []byte("UPDATE \"User\" SET id = id;"), 0644))
+	}
+	addMigration("20221001000000_init")
+
+	locker := &memoryLocker{lock: make(chan struct{}, 1)}
+	runner := NewRunner(Options{
+		MigrationEnginePath: fakeEngine(t, `{"jsonrpc":"2.0","id":1,"result":{"appliedMigrationNames":[]}}`),
+		SchemaPath:          schemaPath,
+		MigrationsDir:       migrationsDir,
+	}, "deploy", locker, time.Second)
+
+	status, err := runner.Migrate(context.Background(), nil)
+	require.NoError(t, err)
+	assert.False(t, status.Skipped)
+	status, err = runner.Migrate(context.Background(), nil)
+	require.NoError(t, err)
+	assert.True(t, status.Skipped, "the same migrations are applied only once")
+
+	// a data migration doesn't change schema.prisma, but must be applied
+	addMigration("20221002000000_backfill")
+	status, err = runner.Migrate(context.Background(), nil)
+	require.NoError(t, err)
+	assert.False(t, status.Skipped)
+}
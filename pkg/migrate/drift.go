@@ -0,0 +1,122 @@
+package migrate
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"sync"
+	"time"
+)
+
+// DriftStatus is the result of comparing the live database with the schema
+type DriftStatus struct {
+	// Drifted is true if the database differs from the schema
+	Drifted     bool       `json:"drifted"`
+	SchemaHash  string     `json:"schemaHash,omitempty"`
+	CheckedAt   time.Time  `json:"checkedAt"`
+	Differences []DiffStep `json:"differences,omitempty"`
+	// Error is set if the check failed, Drifted keeps the result of the last successful check
+	Error string `json:"error,omitempty"`
+}
+
+// DriftDetector periodically diffs the live database against the schema file,
+// e.g. to notice tables that were changed by hand
+type DriftDetector struct {
+	options  Options
+	interval time.Duration
+	// onCheck is called with the status after every check and may be nil
+	onCheck func(*DriftStatus)
+
+	mu     sync.Mutex
+	status *DriftStatus
+}
+
+func NewDriftDetector(options Options, interval time.Duration, onCheck func(*DriftStatus)) *DriftDetector {
+	return &DriftDetector{
+		options:  options,
+		interval: interval,
+		onCheck:  onCheck,
+	}
+}
+
+// Run checks for drift every interval until ctx is done
+func (d *DriftDetector) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		d.Check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check diffs the live database against the schema file once.
+// The differences are logged when drift is detected and when it changes.
+func (d *DriftDetector) Check(ctx context.Context) *DriftStatus {
+	status := &DriftStatus{CheckedAt: time.Now().UTC()}
+	d.mu.Lock()
+	previous := d.status
+	d.mu.Unlock()
+
+	report, err := d.diff(ctx)
+	if err != nil {
+		log.Println("schema drift check", err)
+		status.Error = err.Error()
+		if previous != nil {
+			status.Drifted = previous.Drifted
+			status.SchemaHash = previous.SchemaHash
+			status.Differences = previous.Differences
+		}
+	} else {
+		status.Drifted = !report.Empty
+		status.SchemaHash = report.SchemaHash
+		status.Differences = report.Steps
+		switch {
+		case status.Drifted && (previous == nil || previous.sql() != status.sql()):
+			log.Printf("Schema drift detected, the database differs from the schema in %d steps:", len(report.Steps))
+			for _, step := range report.Steps {
+				log.Printf("  %s: %s", step.Kind, step.SQL)
+			}
+		case !status.Drifted && previous != nil && previous.Drifted:
+			log.Println("Schema drift resolved, the database matches the schema")
+		}
+	}
+
+	d.mu.Lock()
+	d.status = status
+	d.mu.Unlock()
+	if d.onCheck != nil {
+		d.onCheck(status)
+	}
+	return status
+}
+
+// Status returns the result of the last check, or nil before the first check
+func (d *DriftDetector) Status() *DriftStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.status
+}
+
+func (d *DriftDetector) diff(ctx context.Context) (*DiffReport, error) {
+	schema, err := ioutil.ReadFile(d.options.SchemaPath)
+	if err != nil {
+		return nil, err
+	}
+	options := d.options
+	// engine logs of periodic checks are only noise
+	options.OnLog = func(LogLine) {}
+	return DryRun(ctx, options, string(schema))
+}
+
+// sql returns the SQL of all differences, it identifies the drift
+func (s *DriftStatus) sql() string {
+	script := ""
+	for _, step := range s.Differences {
+		script += step.SQL + "\n"
+	}
+	return script
+}
@@ -0,0 +1,90 @@
+package migrate
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+const lockFileVersion = 1
+
+// Lock is the content of the migration lock file.
+// A migration is skipped if the schema hash of the lock matches the current schema.
+type Lock struct {
+	Version       int       `json:"version"`
+	SchemaHash    string    `json:"schemaHash"`
+	EngineVersion string    `json:"engineVersion"`
+	MigratedAt    time.Time `json:"migratedAt"`
+	ExecutedSteps int       `json:"executedSteps"`
+}
+
+// SchemaHash returns the hex encoded sha256 hash of the schema
+func SchemaHash(schema string) string {
+	sum := sha256.Sum256([]byte(schema))
+	return hex.EncodeToString(sum[:])
+}
+
+// ReadLock reads the lock file at path, it returns nil if there is no lock file.
+// Lock files of the legacy format are converted and rewritten.
+func ReadLock(path string) (*Lock, error) {
+	data, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if schema, ok := parseLegacyLock(data); ok {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		lock := &Lock{
+			Version:    lockFileVersion,
+			SchemaHash: SchemaHash(schema),
+			MigratedAt: info.ModTime().UTC(),
+		}
+		log.Printf("Converting legacy migration lock file %s", path)
+		err = WriteLock(path, lock)
+		if err != nil {
+			return nil, err
+		}
+		return lock, nil
+	}
+	lock := &Lock{}
+	err = json.Unmarshal(data, lock)
+	if err != nil {
+		return nil, fmt.Errorf("parse migration lock file %s: %w", path, err)
+	}
+	if lock.Version != lockFileVersion {
+		return nil, fmt.Errorf("unsupported migration lock file version %d", lock.Version)
+	}
+	return lock, nil
+}
+
+// parseLegacyLock returns the schema stored in a legacy lock file.
+// The legacy lock file was written as sha256.New().Sum(schema),
+// which is the schema followed by the digest of an empty input.
+func parseLegacyLock(data []byte) (string, bool) {
+	emptyDigest := sha256.Sum256(nil)
+	if !bytes.HasSuffix(data, emptyDigest[:]) {
+		return "", false
+	}
+	return string(data[:len(data)-len(emptyDigest)]), true
+}
+
+// WriteLock writes the lock file at path
+func WriteLock(path string, lock *Lock) error {
+	data, err := json.MarshalIndent(lock, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
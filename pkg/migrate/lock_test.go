@@ -0,0 +1,47 @@
+package migrate
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "migration.lock")
+
+	lock, err := ReadLock(path)
+	require.NoError(t, err)
+	assert.Nil(t, lock)
+
+	written := &Lock{
+		Version:       lockFileVersion,
+		SchemaHash:    SchemaHash("model User {}"),
+		EngineVersion: "4bc8b6e1b66cb932731fb1bdbbc550d1e010de81",
+		MigratedAt:    time.Date(2022, 10, 1, 0, 0, 0, 0, time.UTC),
+		ExecutedSteps: 2,
+	}
+	require.NoError(t, WriteLock(path, written))
+	lock, err = ReadLock(path)
+	require.NoError(t, err)
+	assert.Equal(t, written, lock)
+}
+
+func TestLegacyLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "migration.lock")
+	schema := "model User {}"
+	require.NoError(t, ioutil.WriteFile(path, sha256.New().Sum([]byte(schema)), 0644))
+
+	lock, err := ReadLock(path)
+	require.NoError(t, err)
+	assert.Equal(t, SchemaHash(schema), lock.SchemaHash)
+
+	// the legacy lock file is rewritten in the current format
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"schemaHash": "`+SchemaHash(schema)+`"`)
+}
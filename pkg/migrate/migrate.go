@@ -1,37 +1,62 @@
 package migrate
 
 import (
-	"bufio"
-	"bytes"
 	"context"
-	"crypto/sha256"
 	"encoding/json"
-	"io/ioutil"
+	"errors"
+	"fmt"
+	"io"
 	"log"
-	"os/exec"
+	"strings"
 	"time"
 )
 
+// Options configures how the database is migrated
+type Options struct {
+	MigrationEnginePath string
+	LockFilePath        string
+	SchemaPath          string
+	// EngineVersion is recorded in the lock file
+	EngineVersion string
+	// AllowDataLoss forces migrations the engine warns about, e.g. dropping a column
+	AllowDataLoss bool
+	// MigrationsDir contains the migration folders applied by ApplyMigrations
+	MigrationsDir string
+	// Timeout limits how long the migration engine may take to answer, defaults to 5 seconds
+	Timeout time.Duration
+	// OnLog receives the log lines of the migration engine, they are logged if it is nil
+	OnLog func(LogLine)
+}
+
 type MigrationRequest struct {
-	Id      int                    `json:"id"`
-	Jsonrpc string                 `json:"jsonrpc"`
-	Method  string                 `json:"method"`
-	Params  MigrationRequestParams `json:"params"`
+	Id      int         `json:"id"`
+	Jsonrpc string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
 }
 
+// MigrationRequestParams are the params of the schemaPush method
 type MigrationRequestParams struct {
 	Force  bool   `json:"force"`
 	Schema string `json:"schema"`
 }
 
+// MigrationResponse is a JSON-RPC message of the migration engine,
+// either the response to our request or a request of the engine itself, e.g. print
 type MigrationResponse struct {
-	Jsonrpc string                   `json:"jsonrpc"`
-	Result  *MigrationResponseResult `json:"result,omitempty"`
-	Error   *MigrationResponseError  `json:"error,omitempty"`
+	Jsonrpc string                  `json:"jsonrpc"`
+	Id      json.RawMessage         `json:"id,omitempty"`
+	Method  string                  `json:"method,omitempty"`
+	Params  json.RawMessage         `json:"params,omitempty"`
+	Result  json.RawMessage         `json:"result,omitempty"`
+	Error   *MigrationResponseError `json:"error,omitempty"`
 }
 
+// MigrationResponseResult is the result of the schemaPush method
 type MigrationResponseResult struct {
-	ExecutedSteps int `json:"executedSteps"`
+	ExecutedSteps int      `json:"executedSteps"`
+	Warnings      []string `json:"warnings"`
+	Unexecutable  []string `json:"unexecutable"`
 }
 
 type MigrationResponseError struct {
@@ -47,94 +72,109 @@ type MigrationResponseErrorData struct {
 }
 
 type MigrationResponseErrorDataMeta struct {
-	FullError string `json:"full_error"`
+	FullError     string `json:"full_error"`
+	MigrationName string `json:"migration_name,omitempty"`
 }
 
-func Database(migrationEnginePath, migrationLockFilePath, schema, schemaPath string) {
-
-	h := sha256.New()
-	expected := h.Sum([]byte(schema))
-	lock, _ := ioutil.ReadFile(migrationLockFilePath)
-	if bytes.Equal(lock, expected) {
-		log.Println("Migration already executed, skipping")
-		return
+func (e *MigrationResponseError) Error() string {
+	if e.Data.Message != "" {
+		return fmt.Sprintf("migration engine error %d: %s", e.Code, e.Data.Message)
 	}
+	return fmt.Sprintf("migration engine error %d: %s", e.Code, e.Message)
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
-	defer cancel()
-	cmd := exec.CommandContext(ctx, migrationEnginePath, "--datamodel", schemaPath)
-	in, err := cmd.StdinPipe()
+// DataLossError is returned if the migration was not applied because it would lose data
+type DataLossError struct {
+	Warnings     []string
+	Unexecutable []string
+}
+
+func (e *DataLossError) Error() string {
+	problems := append(append([]string(nil), e.Warnings...), e.Unexecutable...)
+	return "refusing destructive migration:\n  - " + strings.Join(problems, "\n  - ")
+}
+
+// ErrTimeout is returned when the migration engine did not respond in time
+var ErrTimeout = errors.New("migration engine timed out")
+
+// how long the migration engine gets to answer a request, unless configured otherwise
+const defaultTimeout = 5 * time.Second
+
+// Result is the outcome of a successful migration
+type Result struct {
+	// Skipped is true if the lock file shows the schema was already migrated
+	Skipped       bool  `json:"skipped"`
+	ExecutedSteps int   `json:"executedSteps"`
+	Lock          *Lock `json:"lock,omitempty"`
+}
+
+// Database pushes schema to the database, unless the lock file shows it was already pushed.
+// Changes the engine warns about are refused with a *DataLossError unless options.AllowDataLoss is set.
+// The lock file is only written if the migration succeeded.
+// A failed migration returns a *MigrationResponseError, *DataLossError, ErrTimeout or the error running the engine.
+func Database(ctx context.Context, options Options, schema string) (*Result, error) {
+	schemaHash := SchemaHash(schema)
+	lock, err := ReadLock(options.LockFilePath)
 	if err != nil {
-		log.Fatalln("migration engine std in pipe", err)
+		log.Println("read migration lock file", err)
 	}
-	defer in.Close()
-
-	req := MigrationRequest{
-		Id:      1,
-		Jsonrpc: "2.0",
-		Method:  "schemaPush",
-		Params: MigrationRequestParams{
-			Force:  true,
-			Schema: schema,
-		},
+	if lock != nil && lock.SchemaHash == schemaHash {
+		log.Printf("Migration already executed at %s, skipping", lock.MigratedAt.Format(time.RFC3339))
+		return &Result{Skipped: true, Lock: lock}, nil
 	}
 
-	data, err := json.Marshal(req)
+	var result *MigrationResponseResult
+	err = withClient(ctx, options, func(ctx context.Context, client *Client) error {
+		result, err = client.SchemaPush(ctx, schema, options.AllowDataLoss)
+		return err
+	})
 	if err != nil {
-		log.Fatalln("marshal migration request", err)
+		return nil, err
+	}
+	if len(result.Unexecutable) != 0 || (len(result.Warnings) != 0 && !options.AllowDataLoss) {
+		return nil, &DataLossError{
+			Warnings:     result.Warnings,
+			Unexecutable: result.Unexecutable,
+		}
 	}
-	data = append(data, []byte("\n")...)
-	_, err = in.Write(data)
 
-	out, err := cmd.StdoutPipe()
+	log.Println("Migration successful, updating lock file")
+	lock = &Lock{
+		Version:       lockFileVersion,
+		SchemaHash:    schemaHash,
+		EngineVersion: options.EngineVersion,
+		MigratedAt:    time.Now().UTC(),
+		ExecutedSteps: result.ExecutedSteps,
+	}
+	err = WriteLock(options.LockFilePath, lock)
 	if err != nil {
-		log.Fatalln("migration std out pipe", err)
+		return nil, fmt.Errorf("write migration lock file: %w", err)
 	}
+	return &Result{ExecutedSteps: lock.ExecutedSteps, Lock: lock}, nil
+}
 
-	go func() {
-		r := bufio.NewReader(out)
-		outBuf := &bytes.Buffer{}
-		for {
-			b, err := r.ReadByte()
-			if err != nil {
-				log.Fatalln("migration ReadByte", err)
-			}
-			err = outBuf.WriteByte(b)
-			if err != nil {
-				log.Fatalln("migration writeByte", err)
-			}
-			if b == '\n' {
-				cancel()
-				var resp MigrationResponse
-				err = json.Unmarshal(outBuf.Bytes(), &resp)
-				if err != nil {
-					log.Fatalln("migration unmarshal response", err)
-				}
-				if resp.Error == nil {
-					log.Println("Migration successful, updating lock file")
-					err = ioutil.WriteFile(migrationLockFilePath, expected, 0644)
-					if err != nil {
-						log.Fatalln("migration write lock file", err)
-					}
-					return
-				}
-				pretty, err := json.MarshalIndent(resp, "", "  ")
-				if err != nil {
-					log.Fatalln("migration marshal error", err)
-				}
-				log.Printf("Migration failed:\n%s", string(pretty))
-				return
-			}
-		}
-	}()
-
-	err = cmd.Run()
-	if err != nil && ctx.Err() == nil {
-		log.Println("migration engine run", err)
-		err = nil
+// withClient starts the migration engine, calls fn with ctx limited by options.Timeout
+// and stops the engine afterwards
+func withClient(ctx context.Context, options Options, fn func(ctx context.Context, client *Client) error) error {
+	timeout := options.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	client, err := NewClient(options)
+	if err != nil {
+		return err
 	}
-	err = ioutil.WriteFile(migrationLockFilePath, expected, 0644)
+	defer client.Close()
+	return fn(ctx, client)
+}
+
+func writeMessage(w io.Writer, message interface{}) error {
+	data, err := json.Marshal(message)
 	if err != nil {
-		log.Fatalln("migration write lock file", err)
+		return err
 	}
+	_, err = w.Write(append(data, '\n'))
+	return err
 }
@@ -0,0 +1,215 @@
+package migrate
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeEngine writes a migration engine script that answers every request with response
+func fakeEngine(t *testing.T, response string) string {
+	path := filepath.Join(t.TempDir(), "migration-engine")
+	script := "#!/bin/sh\nwhile read line; do echo '" + response + "'; done\n"
+	require.NoError(t, ioutil.WriteFile(path, []byte(script), 0755))
+	return path
+}
+
+func TestDatabase(t *testing.T) {
+	engine := fakeEngine(t, `{"jsonrpc":"2.0","id":1,"result":{"executedSteps":3}}`)
+	lockPath := filepath.Join(t.TempDir(), "migration.lock")
+
+	options := Options{
+		MigrationEnginePath: engine,
+		LockFilePath:        lockPath,
+		SchemaPath:          "schema.prisma",
+		EngineVersion:       "1.0.0",
+	}
+	result, err := Database(context.Background(), options, "model User {}")
+	require.NoError(t, err)
+	assert.False(t, result.Skipped)
+	assert.Equal(t, 3, result.ExecutedSteps)
+
+	result, err = Database(context.Background(), options, "model User {}")
+	require.NoError(t, err)
+	assert.True(t, result.Skipped)
+	assert.Equal(t, "1.0.0", result.Lock.EngineVersion)
+
+	// the admin API returns the result in the migration status
+	data, err := json.Marshal(result)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"skipped":true,"executedSteps":0,"lock":{`)
+}
+
+func TestDatabaseError(t *testing.T) {
+	engine := fakeEngine(t, `{"jsonrpc":"2.0","id":1,"error":{"code":4466,"message":"An error happened.","data":{"is_panic":false,"message":"P1001 database unreachable"}}}`)
+	lockPath := filepath.Join(t.TempDir(), "migration.lock")
+
+	_, err := Database(context.Background(), Options{
+		MigrationEnginePath: engine,
+		LockFilePath:        lockPath,
+		SchemaPath:          "schema.prisma",
+		EngineVersion:       "1.0.0",
+	}, "model User {}")
+	require.Error(t, err)
+	assert.IsType(t, &MigrationResponseError{}, err)
+	assert.Contains(t, err.Error(), "P1001")
+
+	_, err = os.Stat(lockPath)
+	assert.True(t, os.IsNotExist(err), "lock file must not be written after a failed migration")
+}
+
+func TestParseDiffScript(t *testing.T) {
+	report := parseDiffScript(`/*
+  Warnings:
+
+  - You are about to drop the column ` + "`name`" + ` on the ` + "`User`" + ` table. All the data in the column will be lost.
+
+*/
+-- AlterTable
+ALTER TABLE "User" DROP COLUMN "name";
+
+-- CreateTable
+CREATE TABLE "Post" (
+    "id" SERIAL NOT NULL,
+    CONSTRAINT "Post_pkey" PRIMARY KEY ("id")
+);
+`)
+	assert.False(t, report.Empty)
+	assert.True(t, report.Destructive)
+	assert.Equal(t, []string{"You are about to drop the column `name` on the `User` table. All the data in the column will be lost."}, report.Warnings)
+	require.Len(t, report.Steps, 2)
+	assert.Equal(t, DiffStep{Kind: "AlterTable", SQL: `ALTER TABLE "User" DROP COLUMN "name";`}, report.Steps[0])
+	assert.Equal(t, "CreateTable", report.Steps[1].Kind)
+
+	report = parseDiffScript("-- This is an empty migration.")
+	assert.True(t, report.Empty)
+	assert.False(t, report.Destructive)
+}
+
+func TestDatabaseDataLoss(t *testing.T) {
+	engine := fakeEngine(t, `{"jsonrpc":"2.0","id":1,"result":{"executedSteps":0,"warnings":["You are about to drop the table User."],"unexecutable":[]}}`)
+	lockPath := filepath.Join(t.TempDir(), "migration.lock")
+
+	_, err := Database(context.Background(), Options{
+		MigrationEnginePath: engine,
+		LockFilePath:        lockPath,
+		SchemaPath:          "schema.prisma",
+	}, "model Post {}")
+	require.Error(t, err)
+	assert.Equal(t, &DataLossError{Warnings: []string{"You are about to drop the table User."}, Unexecutable: []string{}}, err)
+
+	_, err = os.Stat(lockPath)
+	assert.True(t, os.IsNotExist(err), "lock file must not be written after a refused migration")
+}
+
+func TestDryRun(t *testing.T) {
+	print := `{"jsonrpc":"2.0","id":7,"method":"print","params":{"content":"-- CreateTable\\nCREATE TABLE \\"Post\\" ();\\n"}}`
+	engine := filepath.Join(t.TempDir(), "migration-engine")
+	script := "#!/bin/sh\nread line\necho '" + print + "'\nread line\necho '{\"jsonrpc\":\"2.0\",\"id\":1,\"result\":{\"exitCode\":0}}'\n"
+	require.NoError(t, ioutil.WriteFile(engine, []byte(script), 0755))
+
+	report, err := DryRun(context.Background(), Options{
+		MigrationEnginePath: engine,
+		SchemaPath:          "schema.prisma",
+	}, "model Post {}")
+	require.NoError(t, err)
+	assert.Equal(t, SchemaHash("model Post {}"), report.SchemaHash)
+	assert.Equal(t, []DiffStep{{Kind: "CreateTable", SQL: `CREATE TABLE "Post" ();`}}, report.Steps)
+	assert.False(t, report.Destructive)
+}
+
+func TestApplyMigrations(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"20221001000000_init", "20221002000000_add_post"} {
+		require.NoError(t, os.Mkdir(filepath.Join(dir, name), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name, "migration.sql"), []byte("SELECT 1;"), 0644))
+	}
+
+	engine := fakeEngine(t, `{"jsonrpc":"2.0","id":1,"result":{"appliedMigrationNames":["20221002000000_add_post"]}}`)
+	result, err := ApplyMigrations(context.Background(), Options{
+		MigrationEnginePath: engine,
+		SchemaPath:          "schema.prisma",
+		MigrationsDir:       dir,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"20221002000000_add_post"}, result.Applied)
+	assert.Equal(t, []string{"20221001000000_init"}, result.AlreadyApplied)
+
+	engine = fakeEngine(t, `{"jsonrpc":"2.0","id":1,"error":{"code":4466,"message":"An error happened.","data":{"is_panic":false,"message":"P3018 A migration failed to apply.","meta":{"migration_name":"20221002000000_add_post"}}}}`)
+	result, err = ApplyMigrations(context.Background(), Options{
+		MigrationEnginePath: engine,
+		SchemaPath:          "schema.prisma",
+		MigrationsDir:       dir,
+	})
+	require.Error(t, err)
+	assert.Equal(t, "20221002000000_add_post", result.Failed)
+}
+
+func TestDeployDryRun(t *testing.T) {
+	dir := t.TempDir()
+	for name, sql := range map[string]string{
+		"20221001000000_init":     "-- CreateTable\nCREATE TABLE \"User\" ();\n",
+		"20221002000000_add_post": "-- CreateTable\nCREATE TABLE \"Post\" ();\n",
+	} {
+		require.NoError(t, os.Mkdir(filepath.Join(dir, name), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name, "migration.sql"), []byte(sql), 0644))
+	}
+	options := Options{
+		SchemaPath:    "schema.prisma",
+		MigrationsDir: dir,
+	}
+
+	options.MigrationEnginePath = fakeEngine(t, `{"jsonrpc":"2.0","id":1,"result":{"history":{"diagnostic":"databaseIsBehind","unappliedMigrationNames":["20221002000000_add_post"]},"failedMigrationNames":[],"editedMigrationNames":[],"hasMigrationsTable":true}}`)
+	report, err := DeployDryRun(context.Background(), options)
+	require.NoError(t, err)
+	assert.False(t, report.Empty)
+	assert.Equal(t, []string{"20221002000000_add_post"}, report.Pending)
+	assert.Equal(t, []DiffStep{{Kind: "CreateTable", SQL: `CREATE TABLE "Post" ();`}}, report.Steps)
+
+	options.MigrationEnginePath = fakeEngine(t, `{"jsonrpc":"2.0","id":1,"result":{"history":null,"failedMigrationNames":[],"editedMigrationNames":[],"hasMigrationsTable":true}}`)
+	report, err = DeployDryRun(context.Background(), options)
+	require.NoError(t, err)
+	assert.True(t, report.Empty)
+	assert.Empty(t, report.Pending)
+
+	options.MigrationEnginePath = fakeEngine(t, `{"jsonrpc":"2.0","id":1,"result":{"history":null,"failedMigrationNames":["20221001000000_init"],"editedMigrationNames":[],"hasMigrationsTable":true}}`)
+	_, err = DeployDryRun(context.Background(), options)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "20221001000000_init")
+}
+
+func TestDriftDetector(t *testing.T) {
+	dir := t.TempDir()
+	schemaPath := filepath.Join(dir, "schema.prisma")
+	require.NoError(t, ioutil.WriteFile(schemaPath, []byte("model Post {}"), 0644))
+	print := `{"jsonrpc":"2.0","id":7,"method":"print","params":{"content":"-- DropTable\\nDROP TABLE \\"Manual\\";\\n"}}`
+	engine := filepath.Join(dir, "migration-engine")
+	script := "#!/bin/sh\nread line\necho '" + print + "'\nread line\necho '{\"jsonrpc\":\"2.0\",\"id\":1,\"result\":{\"exitCode\":2}}'\n"
+	require.NoError(t, ioutil.WriteFile(engine, []byte(script), 0755))
+
+	var checked []*DriftStatus
+	detector := NewDriftDetector(Options{
+		MigrationEnginePath: engine,
+		SchemaPath:          schemaPath,
+	}, time.Minute, func(status *DriftStatus) {
+		checked = append(checked, status)
+	})
+	status := detector.Check(context.Background())
+	assert.True(t, status.Drifted)
+	assert.Equal(t, []DiffStep{{Kind: "DropTable", SQL: `DROP TABLE "Manual";`}}, status.Differences)
+	assert.Equal(t, status, detector.Status())
+
+	// a failed check keeps the last known drift
+	require.NoError(t, os.Remove(engine))
+	status = detector.Check(context.Background())
+	assert.True(t, status.Drifted)
+	assert.NotEmpty(t, status.Error)
+	assert.Len(t, checked, 2)
+}
@@ -0,0 +1,153 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// ErrInProgress is returned if a migration is started while another one is running
+var ErrInProgress = errors.New("migration already in progress")
+
+// Status describes the last migration of a Runner
+type Status struct {
+	// State is "idle", "running", "succeeded" or "failed"
+	State      string     `json:"state"`
+	Mode       string     `json:"mode,omitempty"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	// Skipped is true if the schema was already migrated
+	Skipped bool `json:"skipped"`
+	// Result is a *Result in push mode and an *ApplyResult in deploy mode
+	Result interface{} `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// Runner migrates the database with the configured mode, one migration at a time.
+// It is used at startup and by the admin API.
+type Runner struct {
+	options Options
+	// mode is "push" to push the schema or "deploy" to apply the migrations directory
+	mode string
+	// locker is optional and serializes migrations across replicas
+	locker   Locker
+	lockWait time.Duration
+
+	mu      sync.Mutex
+	running bool
+	status  Status
+}
+
+func NewRunner(options Options, mode string, locker Locker, lockWait time.Duration) *Runner {
+	return &Runner{
+		options:  options,
+		mode:     mode,
+		locker:   locker,
+		lockWait: lockWait,
+		status:   Status{State: "idle"},
+	}
+}
+
+// Migrate migrates the database to the current content of the schema file.
+// onLog receives the log lines of the migration engine and may be nil.
+func (r *Runner) Migrate(ctx context.Context, onLog func(LogLine)) (*Status, error) {
+	r.mu.Lock()
+	if r.running {
+		r.mu.Unlock()
+		return nil, ErrInProgress
+	}
+	r.running = true
+	startedAt := time.Now().UTC()
+	r.status = Status{State: "running", Mode: r.mode, StartedAt: &startedAt}
+	r.mu.Unlock()
+
+	status := Status{State: "succeeded", Mode: r.mode, StartedAt: &startedAt}
+	err := r.migrate(ctx, onLog, &status)
+	finishedAt := time.Now().UTC()
+	status.FinishedAt = &finishedAt
+	if err != nil {
+		status.State = "failed"
+		status.Error = err.Error()
+	}
+
+	r.mu.Lock()
+	r.running = false
+	r.status = status
+	r.mu.Unlock()
+	return &status, err
+}
+
+func (r *Runner) migrate(ctx context.Context, onLog func(LogLine), status *Status) error {
+	data, err := ioutil.ReadFile(r.options.SchemaPath)
+	if err != nil {
+		return err
+	}
+	schema := string(data)
+	options := r.options
+	options.OnLog = onLog
+	migrate := func() error {
+		if r.mode == "deploy" {
+			result, err := ApplyMigrations(ctx, options)
+			if result != nil {
+				status.Result = result
+			}
+			return err
+		}
+		result, err := Database(ctx, options, schema)
+		if err != nil {
+			return err
+		}
+		status.Result = result
+		status.Skipped = result.Skipped
+		return nil
+	}
+	if r.locker == nil {
+		return migrate()
+	}
+	// in deploy mode a release may add migrations without changing the schema
+	hash := SchemaHash(schema)
+	if r.mode == "deploy" {
+		hash, err = MigrationsHash(r.options.MigrationsDir)
+		if err != nil {
+			return err
+		}
+	}
+	// the lock wait doesn't limit the migration itself
+	lockCtx, cancel := context.WithTimeout(ctx, r.lockWait)
+	defer cancel()
+	skipped, err := Coordinate(lockCtx, r.locker, hash, migrate)
+	if skipped {
+		status.Skipped = true
+	}
+	return err
+}
+
+// DryRun reports what migrating to the current content of the schema file would change,
+// in deploy mode these are the pending migrations of the migrations directory
+func (r *Runner) DryRun(ctx context.Context, onLog func(LogLine)) (*DiffReport, error) {
+	data, err := ioutil.ReadFile(r.options.SchemaPath)
+	if err != nil {
+		return nil, err
+	}
+	options := r.options
+	options.OnLog = onLog
+	if r.mode == "deploy" {
+		report, err := DeployDryRun(ctx, options)
+		if err != nil {
+			return nil, err
+		}
+		report.SchemaHash = SchemaHash(string(data))
+		return report, nil
+	}
+	return DryRun(ctx, options, string(data))
+}
+
+// Status returns the status of the running or last migration
+func (r *Runner) Status() *Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status := r.status
+	return &status
+}
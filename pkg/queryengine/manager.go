@@ -0,0 +1,267 @@
+package queryengine
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sync"
+	"time"
+
+	"wunderbase/pkg/migrate"
+)
+
+// ErrReloadInProgress is returned if a reload is requested while another one is running
+var ErrReloadInProgress = errors.New("schema reload already in progress")
+
+// Migrator migrates the database to the schema file before the engine is replaced
+type Migrator interface {
+	Migrate(ctx context.Context, onLog func(migrate.LogLine)) (*migrate.Status, error)
+}
+
+// SwitchFunc sends new requests to engine once it is ready on url.
+// The previous engine is either stopped when it is drained or kept for clients of its schema hash.
+type SwitchFunc func(ctx context.Context, engine *Engine, schemaHash, url, sdlURL string) error
+
+// RetireFunc stops sending requests to a previous engine and stops it once it is drained
+type RetireFunc func(ctx context.Context, engine *Engine)
+
+// InlineSchemaHash returns the schema hash Prisma clients send in the request path,
+// the hex encoded sha256 hash of the base64 encoded schema
+func InlineSchemaHash(schema []byte) string {
+	sum := sha256.Sum256([]byte(base64.StdEncoding.EncodeToString(schema)))
+	return hex.EncodeToString(sum[:])
+}
+
+// ManagerOptions configures a Manager
+type ManagerOptions struct {
+	Config Config
+	// StandbyPort is used by the new engine while the current one is still serving on Config.QueryEnginePort,
+	// the engines alternate between both ports. Without it the schema can't be reloaded.
+	StandbyPort string
+	// Migrator is optional, if set the database is migrated before the new engine is started
+	Migrator Migrator
+	// Timeout limits a reload including the migration, the engine start and draining the previous engine
+	Timeout time.Duration
+}
+
+// ReloadResult describes a reload of the schema file
+type ReloadResult struct {
+	SchemaHash string `json:"schemaHash"`
+	// Reloaded is false if the schema file did not change
+	Reloaded  bool            `json:"reloaded"`
+	Port      string          `json:"port,omitempty"`
+	Migration *migrate.Status `json:"migration,omitempty"`
+}
+
+// Manager replaces the query engine when the schema file changes,
+// without restarting the proxy
+type Manager struct {
+	options  ManagerOptions
+	switchFn SwitchFunc
+	retireFn RetireFunc
+
+	// reloadMu is held for a whole reload, mu only while the fields below are read or replaced,
+	// so a slow migration or engine start doesn't block SchemaHash and Stop
+	reloadMu   sync.Mutex
+	mu         sync.Mutex
+	stopped    bool
+	engine     *Engine
+	port       string
+	schemaHash string
+	// previous is the engine replaced by the last reload, it may still serve clients of the previous schema
+	previous *Engine
+	// failedHash is the schema the last reload failed for, the watcher doesn't retry it
+	failedHash string
+}
+
+func NewManager(options ManagerOptions) *Manager {
+	return &Manager{
+		options: options,
+	}
+}
+
+// Start starts the first engine with the current schema file
+func (m *Manager) Start() (*Engine, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	schemaHash, err := m.readSchemaHash()
+	if err != nil {
+		return nil, err
+	}
+	engine := New(m.config(m.options.Config.QueryEnginePort))
+	err = engine.Start()
+	if err != nil {
+		return nil, err
+	}
+	m.engine = engine
+	m.port = m.options.Config.QueryEnginePort
+	m.schemaHash = schemaHash
+	return engine, nil
+}
+
+// SetSwitch sets how new engines are put in front of the proxy and previous ones are retired,
+// it must be called before Reload
+func (m *Manager) SetSwitch(switchFn SwitchFunc, retireFn RetireFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.switchFn = switchFn
+	m.retireFn = retireFn
+}
+
+// Engine returns the engine serving requests
+func (m *Manager) Engine() *Engine {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.engine
+}
+
+// SchemaHash returns the inline schema hash of the engine serving requests
+func (m *Manager) SchemaHash() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.schemaHash
+}
+
+// config returns the engine config for port
+func (m *Manager) config(port string) Config {
+	config := m.options.Config
+	config.QueryEnginePort = port
+	// without a standby port the engine is started like before schema reload existed
+	config.AlwaysSetPort = m.options.StandbyPort != ""
+	return config
+}
+
+// Stop stops the engine serving requests and the previous engine,
+// an engine started by a running reload is stopped once the reload finished
+func (m *Manager) Stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stopped = true
+	m.engine.Stop()
+	if m.previous != nil {
+		m.previous.Stop()
+	}
+}
+
+// Reload starts a new engine if the schema file changed since the current engine was started.
+// The database is migrated first if a Migrator is configured, a failed migration keeps the current engine.
+func (m *Manager) Reload(ctx context.Context) (*ReloadResult, error) {
+	if !m.reloadMu.TryLock() {
+		return nil, ErrReloadInProgress
+	}
+	defer m.reloadMu.Unlock()
+	// only reloads replace these fields, so they don't change until this one is finished
+	m.mu.Lock()
+	switchFn, retireFn := m.switchFn, m.retireFn
+	currentPort, currentHash, previous := m.port, m.schemaHash, m.previous
+	m.mu.Unlock()
+	if switchFn == nil || retireFn == nil {
+		return nil, errors.New("query engine manager has no switch")
+	}
+	if m.options.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.options.Timeout)
+		defer cancel()
+	}
+	schemaHash, err := m.readSchemaHash()
+	if err != nil {
+		return nil, err
+	}
+	result := &ReloadResult{SchemaHash: schemaHash}
+	if schemaHash == currentHash {
+		return result, nil
+	}
+	m.mu.Lock()
+	m.failedHash = schemaHash
+	m.mu.Unlock()
+	if m.options.StandbyPort == "" {
+		return result, errors.New("schema reload requires a standby port for the new query engine")
+	}
+	log.Printf("Schema changed to %s, reloading query engine", schemaHash)
+	if m.options.Migrator != nil {
+		result.Migration, err = m.options.Migrator.Migrate(ctx, nil)
+		if err != nil {
+			return result, fmt.Errorf("migrate: %w", err)
+		}
+	}
+
+	port := m.options.StandbyPort
+	if currentPort == port {
+		port = m.options.Config.QueryEnginePort
+	}
+	if previous != nil {
+		// the previous engine still uses the port of the new engine
+		retireFn(ctx, previous)
+		m.mu.Lock()
+		m.previous = nil
+		m.mu.Unlock()
+	}
+	engine := New(m.config(port))
+	err = engine.Start()
+	if err != nil {
+		return result, err
+	}
+	err = switchFn(ctx, engine, schemaHash, fmt.Sprintf("http://localhost:%s/", port), fmt.Sprintf("http://localhost:%s/sdl", port))
+	if err != nil {
+		engine.Stop()
+		return result, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stopped {
+		engine.Stop()
+		return result, errors.New("query engine manager stopped during the reload")
+	}
+	m.previous = m.engine
+	m.engine = engine
+	m.port = port
+	m.schemaHash = schemaHash
+	m.failedHash = ""
+	result.Reloaded = true
+	result.Port = port
+	log.Printf("Query engine reloaded on port %s", port)
+	return result, nil
+}
+
+// Watch reloads the engine whenever the content of the schema file changes, until ctx is done.
+// The file is polled every interval.
+func (m *Manager) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		schemaHash, err := m.readSchemaHash()
+		if err != nil {
+			log.Println("watch prisma schema", err)
+			continue
+		}
+		m.mu.Lock()
+		changed := schemaHash != m.schemaHash && schemaHash != m.failedHash
+		m.mu.Unlock()
+		if !changed {
+			continue
+		}
+		_, err = m.Reload(ctx)
+		if err != nil && err != ErrReloadInProgress {
+			log.Println("reload prisma schema", err)
+		}
+	}
+}
+
+func (m *Manager) readSchemaHash() (string, error) {
+	schema, err := ioutil.ReadFile(m.options.Config.PrismaSchemaFilePath)
+	if err != nil {
+		return "", fmt.Errorf("read prisma schema: %w", err)
+	}
+	return InlineSchemaHash(schema), nil
+}
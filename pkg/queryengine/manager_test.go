@@ -0,0 +1,177 @@
+package queryengine
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"wunderbase/pkg/migrate"
+)
+
+func TestManagerReload(t *testing.T) {
+	dir := t.TempDir()
+	enginePath := filepath.Join(dir, "query-engine")
+	require.NoError(t, ioutil.WriteFile(enginePath, []byte("#!/bin/sh\nexec sleep 60\n"), 0755))
+	schemaPath := filepath.Join(dir, "schema.prisma")
+	require.NoError(t, ioutil.WriteFile(schemaPath, []byte("model User {}"), 0644))
+
+	manager := NewManager(ManagerOptions{
+		Config: Config{
+			QueryEnginePath:      enginePath,
+			QueryEnginePort:      "4467",
+			PrismaSchemaFilePath: schemaPath,
+			Production:           true,
+		},
+		StandbyPort: "4468",
+	})
+	first, err := manager.Start()
+	require.NoError(t, err)
+	defer manager.Stop()
+
+	var switchedTo []string
+	var retired []*Engine
+	var switchErr error
+	manager.SetSwitch(func(ctx context.Context, engine *Engine, schemaHash, url, sdlURL string) error {
+		if switchErr != nil {
+			return switchErr
+		}
+		switchedTo = append(switchedTo, url)
+		return nil
+	}, func(ctx context.Context, engine *Engine) {
+		retired = append(retired, engine)
+		engine.Stop()
+	})
+
+	result, err := manager.Reload(context.Background())
+	require.NoError(t, err)
+	assert.False(t, result.Reloaded, "unchanged schema must not be reloaded")
+
+	require.NoError(t, ioutil.WriteFile(schemaPath, []byte("model User {}\nmodel Post {}"), 0644))
+	result, err = manager.Reload(context.Background())
+	require.NoError(t, err)
+	assert.True(t, result.Reloaded)
+	assert.Equal(t, "4468", result.Port)
+	assert.Equal(t, InlineSchemaHash([]byte("model User {}\nmodel Post {}")), result.SchemaHash)
+	assert.Equal(t, []string{"http://localhost:4468/"}, switchedTo)
+	assert.NotSame(t, first, manager.Engine())
+	assert.True(t, manager.Engine().Running())
+	// the first engine may still serve clients of the previous schema
+	assert.True(t, first.Running())
+
+	// the next engine reuses the port of the first one, so it is retired first
+	current := manager.Engine()
+	require.NoError(t, ioutil.WriteFile(schemaPath, []byte("model Post {}"), 0644))
+	result, err = manager.Reload(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "4467", result.Port)
+	assert.Equal(t, []*Engine{first}, retired)
+	assert.False(t, first.Running())
+
+	// a failed switch keeps the current engine and stops the new one
+	current = manager.Engine()
+	switchErr = errors.New("not ready")
+	require.NoError(t, ioutil.WriteFile(schemaPath, []byte("model Comment {}"), 0644))
+	_, err = manager.Reload(context.Background())
+	require.Error(t, err)
+	assert.Same(t, current, manager.Engine())
+	assert.True(t, current.Running())
+}
+
+// blockingMigrator blocks the reload until release is closed
+type blockingMigrator struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingMigrator) Migrate(ctx context.Context, onLog func(migrate.LogLine)) (*migrate.Status, error) {
+	close(b.started)
+	<-b.release
+	return &migrate.Status{State: "succeeded"}, nil
+}
+
+func TestManagerReloadDoesNotBlock(t *testing.T) {
+	dir := t.TempDir()
+	enginePath := filepath.Join(dir, "query-engine")
+	require.NoError(t, ioutil.WriteFile(enginePath, []byte("#!/bin/sh\nexec sleep 60\n"), 0755))
+	schemaPath := filepath.Join(dir, "schema.prisma")
+	require.NoError(t, ioutil.WriteFile(schemaPath, []byte("model User {}"), 0644))
+
+	migrator := &blockingMigrator{started: make(chan struct{}), release: make(chan struct{})}
+	manager := NewManager(ManagerOptions{
+		Config: Config{
+			QueryEnginePath:      enginePath,
+			QueryEnginePort:      "4467",
+			PrismaSchemaFilePath: schemaPath,
+			Production:           true,
+		},
+		StandbyPort: "4468",
+		Migrator:    migrator,
+	})
+	_, err := manager.Start()
+	require.NoError(t, err)
+	defer manager.Stop()
+	manager.SetSwitch(func(ctx context.Context, engine *Engine, schemaHash, url, sdlURL string) error {
+		return nil
+	}, func(ctx context.Context, engine *Engine) {
+		engine.Stop()
+	})
+
+	require.NoError(t, ioutil.WriteFile(schemaPath, []byte("model Post {}"), 0644))
+	reloaded := make(chan error)
+	go func() {
+		_, err := manager.Reload(context.Background())
+		reloaded <- err
+	}()
+	<-migrator.started
+
+	// the migration is running, but the current engine is still available
+	assert.Equal(t, InlineSchemaHash([]byte("model User {}")), manager.SchemaHash())
+	assert.True(t, manager.Engine().Running())
+	_, err = manager.Reload(context.Background())
+	assert.Equal(t, ErrReloadInProgress, err)
+
+	close(migrator.release)
+	require.NoError(t, <-reloaded)
+	assert.Equal(t, InlineSchemaHash([]byte("model Post {}")), manager.SchemaHash())
+}
+
+func TestManagerReloadWithoutStandbyPort(t *testing.T) {
+	dir := t.TempDir()
+	enginePath := filepath.Join(dir, "query-engine")
+	require.NoError(t, ioutil.WriteFile(enginePath, []byte("#!/bin/sh\nexec sleep 60\n"), 0755))
+	schemaPath := filepath.Join(dir, "schema.prisma")
+	require.NoError(t, ioutil.WriteFile(schemaPath, []byte("model User {}"), 0644))
+
+	manager := NewManager(ManagerOptions{
+		Config: Config{
+			QueryEnginePath:      enginePath,
+			QueryEnginePort:      "4467",
+			PrismaSchemaFilePath: schemaPath,
+			Production:           true,
+		},
+	})
+	first, err := manager.Start()
+	require.NoError(t, err)
+	defer manager.Stop()
+	assert.False(t, first.config.AlwaysSetPort, "without a standby port the engine is started without --port in production")
+	manager.SetSwitch(func(ctx context.Context, engine *Engine, schemaHash, url, sdlURL string) error {
+		return nil
+	}, func(ctx context.Context, engine *Engine) {
+		engine.Stop()
+	})
+
+	require.NoError(t, ioutil.WriteFile(schemaPath, []byte("model Post {}"), 0644))
+	_, err = manager.Reload(context.Background())
+	require.Error(t, err)
+	assert.Same(t, first, manager.Engine())
+}
+
+func TestInlineSchemaHash(t *testing.T) {
+	// sha256 of base64("model User {}")
+	assert.Equal(t, "f18fc9d02e26e167d0835aae2e703121ac54f909c5f51c2dc8689b5b6d9d3602", InlineSchemaHash([]byte("model User {}")))
+}
@@ -2,7 +2,6 @@ package queryengine
 
 import (
 	"bytes"
-	"context"
 	"fmt"
 	"log"
 	"os"
@@ -11,61 +10,161 @@ import (
 	"strings"
 	"sync"
 	"syscall"
-	"wunderbase/pkg/api"
+	"time"
 )
 
-func Run(ctx context.Context, wg *sync.WaitGroup, queryEnginePath, queryEnginePort, prismaSchemaFilePath string, production bool) {
+// how long the query engine gets to exit after SIGTERM before it is killed
+const stopTimeout = 10 * time.Second
+
+// Config configures the query engine process
+type Config struct {
+	QueryEnginePath           string
+	QueryEnginePort           string
+	PrismaSchemaFilePath      string
+	Production                bool
+	HostBind                  string
+	EnableRawQueries          bool
+	EnableLog                 bool
+	EnableMetrics             bool
+	EnableOpenTelemetry       bool
+	OpenTelemetryEndpoint     string
+	EnableTelemetryInResponse bool
+	// AlwaysSetPort passes QueryEnginePort in production as well,
+	// where the engine otherwise listens on its default port or $PORT
+	AlwaysSetPort bool
+}
+
+// Engine is a query engine process that can be started and stopped repeatedly,
+// e.g. by sleep mode when the proxy is idle
+type Engine struct {
+	config Config
+
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	exited chan struct{}
+}
+
+func New(config Config) *Engine {
+	return &Engine{
+		config: config,
+	}
+}
+
+// Start starts the query engine process, unless it is already running
+func (e *Engine) Start() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.running() {
+		return nil
+	}
 	// when start prisma query engine ,
 	// we're not able to listen on the same port,
 	// if last engine instance still alive.
 	// so we must kill the existing engine process before we start new onw.
 
-	args := []string{"--datamodel-path", prismaSchemaFilePath}
-	
-	args = append(args, "--host", api.AdditionalConfig.QueryEngineHostBind)
+	args := []string{"--datamodel-path", e.config.PrismaSchemaFilePath}
 
-	if !production {
-		killExistingPrismaQueryEngineProcess(queryEnginePort)
-		args = append(args, "--enable-playground", "--port", queryEnginePort)
+	args = append(args, "--host", e.config.HostBind)
+
+	// a reloaded engine runs on the standby port, so with schema reload the port is set in production as well
+	if !e.config.Production || e.config.AlwaysSetPort {
+		args = append(args, "--port", e.config.QueryEnginePort)
 	}
 
-	if api.AdditionalConfig.EnableRawQueries {
+	if !e.config.Production {
+		killExistingPrismaQueryEngineProcess(e.config.QueryEnginePort)
+		args = append(args, "--enable-playground")
+	}
+
+	if e.config.EnableRawQueries {
 		args = append(args, "--enable-raw-queries")
 	}
 
-	if api.AdditionalConfig.EnableQueryEngineLog {
+	if e.config.EnableLog {
 		args = append(args, "--log-queries")
 	}
 
-	if api.AdditionalConfig.EnableMetrics {
+	if e.config.EnableMetrics {
 		args = append(args, "--enable-metrics", "--dataproxy-metric-override")
 	}
 
-	if api.AdditionalConfig.EnableOpenTelemetry {
+	if e.config.EnableOpenTelemetry {
 		args = append(args, "--enable-open-telemetry")
-		if api.AdditionalConfig.OpenTelemetryEndpoint != "" {
-			args = append(args, "--open-telemetry-endpoint", api.AdditionalConfig.OpenTelemetryEndpoint)
+		if e.config.OpenTelemetryEndpoint != "" {
+			args = append(args, "--open-telemetry-endpoint", e.config.OpenTelemetryEndpoint)
 		}
 	}
 
-	if api.AdditionalConfig.EnableTelemetryInResponse {
+	if e.config.EnableTelemetryInResponse {
 		args = append(args, "--enable-telemetry-in-response")
 	}
 
-	cmd := exec.CommandContext(ctx, queryEnginePath, args...)
+	cmd := exec.Command(e.config.QueryEnginePath, args...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	err := cmd.Start()
 	if err != nil {
-		log.Fatalln("run query engine", err)
+		return fmt.Errorf("run query engine: %w", err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		_ = cmd.Wait()
+		close(exited)
+	}()
+	e.cmd = cmd
+	e.exited = exited
+	log.Println("Query Engine started")
+	return nil
+}
+
+// Stop stops the query engine process, if it is running
+func (e *Engine) Stop() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.running() {
+		return
+	}
+	stop(e.cmd, e.exited)
+	e.cmd = nil
+	log.Println("Query Engine stopped")
+}
+
+// Running reports whether the query engine process is alive
+func (e *Engine) Running() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.running()
+}
+
+func (e *Engine) running() bool {
+	if e.cmd == nil {
+		return false
+	}
+	select {
+	case <-e.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+// stop asks the query engine to terminate gracefully and kills it
+// if it didn't exit within stopTimeout
+func stop(cmd *exec.Cmd, exited <-chan struct{}) {
+	err := cmd.Process.Signal(syscall.SIGTERM)
+	if err == nil {
+		select {
+		case <-exited:
+			return
+		case <-time.After(stopTimeout):
+			log.Printf("Query Engine did not exit within %s, killing it", stopTimeout)
+		}
 	}
-	<-ctx.Done()
 	err = cmd.Process.Kill()
-	if err != nil {
+	if err != nil && err != os.ErrProcessDone {
 		log.Println("kill query engine", err)
 	}
-	log.Println("Query Engine stopped")
-	wg.Done()
+	<-exited
 }
 
 // reference:https://github.com/wundergraph/wundergraph